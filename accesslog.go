@@ -0,0 +1,196 @@
+package wrap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessEntry is the access log record of a request
+type AccessEntry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Proto      string        `json:"proto"`
+	Code       int           `json:"status"`
+	Size       int           `json:"size"`
+	Duration   time.Duration `json:"duration"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+}
+
+// AccessSink receives the AccessEntry of every request served by
+// AccessLog
+type AccessSink interface {
+	Log(entry *AccessEntry)
+}
+
+// AccessSinkFunc adapts a function to an AccessSink
+type AccessSinkFunc func(entry *AccessEntry)
+
+// Log satisfies the AccessSink interface
+func (fn AccessSinkFunc) Log(entry *AccessEntry) {
+	fn(entry)
+}
+
+// AccessLog returns a ChainerFunc emitting an AccessEntry to sink
+// after the wrapped handler returns. The status code and body size
+// are read from the BufferWriter the handler wrote to, the writer
+// passed in when it is one, otherwise a BufferWriter AccessLog
+// flushes itself before logging, so they are exact without a
+// recording writer. A BufferWriter passed in is read when the handler
+// returns, before its owner flushes it, so the entry doesn't reflect
+// its transformers or Strict check. The size of a HEAD response is
+// 0. When the handler panics the request is logged as a 500 with a
+// size of 0 and nothing is flushed, the panic goes on to an outer
+// Recover.
+func AccessLog(sink AccessSink) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r, span := startSpan(r, "wrap.AccessLog")
+			defer span.End()
+			buffer, ok := w.(*BufferWriter)
+			if !ok {
+				buffer = NewRequestBufferWriter(w, r)
+			}
+			completed := false
+			defer func() {
+				if completed && !ok {
+					buffer.FlushAll()
+				}
+				sink.Log(accessEntry(buffer, r, start, completed))
+			}()
+			handler.ServeHTTP(buffer, r)
+			completed = true
+		})
+	}
+}
+
+// accessEntry builds the AccessEntry of r from the state of bf, a
+// request that didn't complete failed with a 500
+func accessEntry(bf *BufferWriter, r *http.Request, start time.Time, completed bool) *AccessEntry {
+	entry := &AccessEntry{
+		Time:       start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Code:       bf.Code,
+		Size:       bf.Size(),
+		Duration:   time.Since(start),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.RemoteAddr = host
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		entry.User = user
+	} else if r.URL.User != nil {
+		entry.User = r.URL.User.Username()
+	}
+	if entry.Code == 0 {
+		entry.Code = http.StatusOK
+	}
+	if bf.Head {
+		entry.Size = 0
+	}
+	if !completed {
+		entry.Code = http.StatusInternalServerError
+		entry.Size = 0
+	}
+	return entry
+}
+
+// lockedWriter serializes the lines sinks write to w
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) write(line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.w.Write(line)
+}
+
+// clfDash returns - for an empty Common Log Format field
+func clfDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// commonLine formats entry in Common Log Format without the newline
+func commonLine(entry *AccessEntry) string {
+	size := "-"
+	if entry.Size > 0 {
+		size = strconv.Itoa(entry.Size)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		clfDash(entry.RemoteAddr), clfDash(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Proto, entry.Code, size)
+}
+
+// CommonLog returns an AccessSink writing Common Log Format lines to
+// w
+func CommonLog(w io.Writer) AccessSink {
+	lw := &lockedWriter{w: w}
+	return AccessSinkFunc(func(entry *AccessEntry) {
+		lw.write([]byte(commonLine(entry) + "\n"))
+	})
+}
+
+// CombinedLog returns an AccessSink writing Combined Log Format
+// lines, Common Log Format with the referer and user agent, to w
+func CombinedLog(w io.Writer) AccessSink {
+	lw := &lockedWriter{w: w}
+	return AccessSinkFunc(func(entry *AccessEntry) {
+		lw.write([]byte(fmt.Sprintf("%s %q %q\n", commonLine(entry),
+			clfDash(entry.Referer), clfDash(entry.UserAgent))))
+	})
+}
+
+// JSONLog returns an AccessSink writing an AccessEntry JSON object per
+// line to w, the duration in nanoseconds
+func JSONLog(w io.Writer) AccessSink {
+	lw := &lockedWriter{w: w}
+	return AccessSinkFunc(func(entry *AccessEntry) {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		lw.write(append(line, '\n'))
+	})
+}
+
+// SlogLog returns an AccessSink logging an info record with the
+// AccessEntry attributes to logger
+func SlogLog(logger *slog.Logger) AccessSink {
+	return AccessSinkFunc(func(entry *AccessEntry) {
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "access",
+			slog.Time("time", entry.Time),
+			slog.String("remote_addr", entry.RemoteAddr),
+			slog.String("user", entry.User),
+			slog.String("method", entry.Method),
+			slog.String("path", entry.Path),
+			slog.String("proto", entry.Proto),
+			slog.Int("status", entry.Code),
+			slog.Int("size", entry.Size),
+			slog.Duration("duration", entry.Duration),
+			slog.String("referer", entry.Referer),
+			slog.String("user_agent", entry.UserAgent))
+	})
+}
@@ -0,0 +1,51 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_AccessLog(t *testing.T) {
+	var common, combined, lines, slogged bytes.Buffer
+	sinks := []AccessSink{
+		CommonLog(&common),
+		CombinedLog(&combined),
+		JSONLog(&lines),
+		SlogLog(slog.New(slog.NewTextHandler(&slogged, nil))),
+	}
+	for _, sink := range sinks {
+		req := httptest.NewRequest("GET", "/path?q=1", nil)
+		req.Header.Set("User-Agent", "agent")
+		req.SetBasicAuth("user", "secret")
+		rec := httptest.NewRecorder()
+		HttpScopedHandlerWriter(AccessLog(sink)(Chain(a, unauthorized))).ServeHTTP(rec, req)
+	}
+	clf := `^192\.0\.2\.1 - user \[[^]]+\] "GET /path\?q=1 HTTP/1\.1" 401 22`
+	if !regexp.MustCompile(clf + "\n$").MatchString(common.String()) {
+		t.Errorf("unexpected common log %q", common.String())
+	}
+	if !regexp.MustCompile(clf + ` "-" "agent"` + "\n$").MatchString(combined.String()) {
+		t.Errorf("unexpected combined log %q", combined.String())
+	}
+	var entry AccessEntry
+	if err := json.Unmarshal(lines.Bytes(), &entry); err != nil || entry.Code != 401 || entry.Size != 22 || entry.Path != "/path?q=1" {
+		t.Errorf("unexpected json log %q %v", lines.String(), err)
+	}
+	if !strings.Contains(slogged.String(), "status=401 size=22") {
+		t.Errorf("unexpected slog log %q", slogged.String())
+	}
+
+	var logged *AccessEntry
+	var flushed int
+	rec := httptest.NewRecorder()
+	AccessLog(AccessSinkFunc(func(e *AccessEntry) { logged, flushed = e, rec.Body.Len() }))(A).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, Response()) || logged == nil || logged.Code != http.StatusOK || logged.Size != 9 || flushed != 9 {
+		t.Fatalf("unexpected entry %+v %d", logged, flushed)
+	}
+}
@@ -0,0 +1,126 @@
+package wrap
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// AdaptiveMin is the smallest capacity an AdaptivePool allocates
+var AdaptiveMin = 512
+
+// AdaptivePool is a StatsPool sizing buffers from the body sizes it
+// observes. Put records the length of the returned buffer, the body
+// BPFlushAll wrote, in a window of recent sizes. New buffers are
+// allocated with the chosen percentile of the window and buffers
+// grown past factor times that size are dropped rather than retained.
+// Route returns a pool observing a route on its own, the
+// AdaptivePool itself observes every response returned to it.
+type AdaptivePool struct {
+	poolCounters
+	pool       sync.Pool
+	percentile float64
+	factor     int
+	alloc      atomic.Int64
+
+	mu      sync.Mutex
+	samples []int
+	next    int
+	filled  bool
+	routes  map[string]*AdaptivePool
+}
+
+// NewAdaptivePool returns an AdaptivePool sizing new buffers to the
+// percentile, between 0 and 1, of the last window body sizes, and
+// dropping buffers larger than factor times that size. Until sizes
+// are observed buffers are allocated with BPAlloc capacity.
+func NewAdaptivePool(percentile float64, window, factor int) *AdaptivePool {
+	if percentile < 0 {
+		percentile = 0
+	}
+	if percentile > 1 {
+		percentile = 1
+	}
+	if window < 1 {
+		window = 1
+	}
+	p := &AdaptivePool{
+		percentile: percentile,
+		factor:     factor,
+		samples:    make([]int, window),
+		routes:     make(map[string]*AdaptivePool),
+	}
+	p.alloc.Store(int64(BPAlloc))
+	return p
+}
+
+// Route returns the AdaptivePool sizing buffers for the route key,
+// created with the settings of p on first use
+func (p *AdaptivePool) Route(key string) *AdaptivePool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	route, ok := p.routes[key]
+	if !ok {
+		route = NewAdaptivePool(p.percentile, len(p.samples), p.factor)
+		p.routes[key] = route
+	}
+	return route
+}
+
+// Alloc returns the capacity new buffers are allocated with
+func (p *AdaptivePool) Alloc() int {
+	return int(p.alloc.Load())
+}
+
+// Get returns a pooled buffer or a new one sized by the observed
+// percentile
+func (p *AdaptivePool) Get() *bytes.Buffer {
+	b, ok := p.pool.Get().(*bytes.Buffer)
+	p.get(!ok)
+	if ok {
+		return b
+	}
+	return bytes.NewBuffer(make([]byte, 0, p.Alloc()))
+}
+
+// Put records the length of b as a body size, then resets b and
+// retains it unless it is far larger than the observed percentile
+func (p *AdaptivePool) Put(b *bytes.Buffer) {
+	p.observe(b.Len())
+	discard := p.factor > 0 && b.Cap() > p.factor*p.Alloc()
+	p.put(b, discard)
+	if discard {
+		return
+	}
+	b.Reset()
+	p.pool.Put(b)
+}
+
+// observe records size in the window and recomputes the allocation
+// size once the window is filled and then every time it wraps by an
+// eighth
+func (p *AdaptivePool) observe(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.samples[p.next] = size
+	p.next = (p.next + 1) % len(p.samples)
+	if p.next == 0 {
+		p.filled = true
+	}
+	n := p.next
+	if p.filled {
+		n = len(p.samples)
+	}
+	if step := len(p.samples)/8 + 1; p.next%step != 0 && n != 1 {
+		return
+	}
+	sorted := make([]int, n)
+	copy(sorted, p.samples[:n])
+	sort.Ints(sorted)
+	alloc := sorted[int(p.percentile*float64(n-1))]
+	if alloc < AdaptiveMin {
+		alloc = AdaptiveMin
+	}
+	p.alloc.Store(int64(alloc))
+}
@@ -27,10 +27,43 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package wrap
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"reflect"
+	"strconv"
 )
 
+// ErrBuffered is returned by BufferWriter.Hijack when the response
+// was already buffered or committed
+var ErrBuffered = errors.New("wrap: hijack of a buffered response")
+
+// BufferWriter passes http.Flusher, http.Hijacker and io.ReaderFrom
+// type assertions through the buffer
+var (
+	_ http.Flusher  = (*BufferWriter)(nil)
+	_ http.Hijacker = (*BufferWriter)(nil)
+	_ io.ReaderFrom = (*BufferWriter)(nil)
+)
+
+// Contexter is a ResponseWriter carrying per request values, stored
+// and retrieved by the type of the pointer passed
+type Contexter interface {
+	// Context sets the value ctxPtr points to from the stored value of
+	// the same type, returning false if nothing was stored
+	Context(ctxPtr interface{}) bool
+
+	// SetContext stores the value ctxPtr points to
+	SetContext(ctxPtr interface{})
+}
+
+// BufferWriter implements Buffer
+var _ Buffer = (*BufferWriter)(nil)
+
 type Buffer interface {
 	Context(ctxPtr interface{}) bool
 	SetContext(ctxPtr interface{})
@@ -61,18 +94,59 @@ type BufferWriter struct {
 	// Code is the cached status code
 	Code int
 
+	// Threshold when greater than 0 is the number of body bytes
+	// buffered before the response is committed with Flush and the
+	// rest of the body streams to ResponseWriter
+	Threshold int
+
+	// Limit when greater than 0 is the maximum body size, a Write past
+	// it fails with a *LimitError and so does every later Write, so
+	// the body has no gap
+	Limit int
+
+	// Strict fails the response with a 500 when the handler set a
+	// Content-Length that doesn't match the buffered body
+	Strict bool
+
+	// Head suppresses the body of the response to a HEAD request,
+	// Content-Length still reports the buffered body, or the one the
+	// handler declared when it buffered none
+	Head bool
+
 	// changed tracks modifications to ResponseWriter and reads from the
 	// header - tracked as changes
 	changed bool
 
 	// header is the cached header
 	header http.Header
+
+	// committed is set by Flush after the status code and headers were
+	// sent to ResponseWriter, writes then bypass the buffer
+	committed bool
+
+	// hijacked is set after a successful Hijack
+	hijacked bool
+
+	// size is the number of body bytes written, buffered or streamed
+	size int
+
+	// overflow is the first *LimitError returned by Write
+	overflow *LimitError
+
+	// transformers run over the buffered response before FlushAll
+	transformers []Transformer
+
+	// pool is the Pool Buffer was taken from by NewPoolWriter
+	pool Pool
+
+	// contexts are the per request values set by SetContext keyed by
+	// type
+	contexts map[reflect.Type]reflect.Value
 }
 
 // NewBufferWriter returns a BufferWriter wrapping the given response
 // writer.
 func NewBufferWriter(w http.ResponseWriter) (bf *BufferWriter) {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	bf = &BufferWriter{}
 	bf.ResponseWriter = w
 	bf.header = make(http.Header)
@@ -80,33 +154,228 @@ func NewBufferWriter(w http.ResponseWriter) (bf *BufferWriter) {
 	return
 }
 
+// NewRequestBufferWriter returns a BufferWriter wrapping the given
+// response writer for serving r, suppressing the body of a HEAD
+// request unless w is a Buffer itself.
+func NewRequestBufferWriter(w http.ResponseWriter, r *http.Request) (bf *BufferWriter) {
+	bf = NewBufferWriter(w)
+	bf.Head = headWriter(w, r)
+	return
+}
+
+// headWriter returns true when the BufferWriter wrapping w to serve r
+// drops the body of a HEAD response. Only the writer wrapping the
+// connection does, a Buffer below receives the body and measures it.
+func headWriter(w http.ResponseWriter, r *http.Request) bool {
+	_, buffered := w.(Buffer)
+	return r.Method == http.MethodHead && !buffered
+}
+
+// Context sets the value ctxPtr points to from the value of the
+// same type stored by SetContext, returning false if none was
+// stored. If the wrapped ResponseWriter is a Contexter the lookup is
+// delegated to it so nested buffers share their values. Context
+// panics if ctxPtr isn't a non nil pointer.
+func (bf *BufferWriter) Context(ctxPtr interface{}) bool {
+	if ctx, ok := bf.ResponseWriter.(Contexter); ok {
+		return ctx.Context(ctxPtr)
+	}
+	ptr := contextPtr(ctxPtr)
+	value, found := bf.contexts[ptr.Type().Elem()]
+	if found {
+		ptr.Elem().Set(value)
+	}
+	return found
+}
+
+// SetContext stores the value ctxPtr points to, replacing a value of
+// the same type. If the wrapped ResponseWriter is a Contexter the
+// value is stored there. SetContext panics if ctxPtr isn't a non nil
+// pointer.
+func (bf *BufferWriter) SetContext(ctxPtr interface{}) {
+	if ctx, ok := bf.ResponseWriter.(Contexter); ok {
+		ctx.SetContext(ctxPtr)
+		return
+	}
+	ptr := contextPtr(ctxPtr)
+	if bf.contexts == nil {
+		bf.contexts = make(map[reflect.Type]reflect.Value)
+	}
+	value := reflect.New(ptr.Type().Elem()).Elem()
+	value.Set(ptr.Elem())
+	bf.contexts[value.Type()] = value
+}
+
+// contextPtr validates the argument of Context and SetContext
+func contextPtr(ctxPtr interface{}) reflect.Value {
+	ptr := reflect.ValueOf(ctxPtr)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		panic("wrap: context value must be a non nil pointer")
+	}
+	return ptr
+}
+
 // Header returns the cached http.Header and tracks this call as
-// change
+// change, after Flush the ResponseWriter's header is returned
 func (bf *BufferWriter) Header() http.Header {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	bf.changed = true
+	if bf.committed {
+		return bf.ResponseWriter.Header()
+	}
 	return bf.header
 }
 
 // WriteHeader writes the cached status code and tracks this call as
-// change
+// change, after Flush the status code can't change and the call is
+// ignored
 func (bf *BufferWriter) WriteHeader(i int) {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	bf.changed = true
-	bf.Code = i
+	if !bf.committed {
+		bf.Code = i
+	}
 }
 
 // Write writes to the underlying buffer and tracks this call as
-// change
-func (bf *BufferWriter) Write(b []byte) (int, error) {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+// change, after Flush it writes to the ResponseWriter. A write
+// growing the body past Limit, or any write after it, writes
+// nothing and returns a *LimitError.
+func (bf *BufferWriter) Write(b []byte) (n int, err error) {
 	bf.changed = true
-	return bf.Buffer.Write(b)
+	switch {
+	case bf.hijacked:
+		return 0, http.ErrHijacked
+	case bf.Limit > 0 && (bf.overflow != nil || bf.size+len(b) > bf.Limit):
+		if bf.overflow == nil {
+			bf.overflow = &LimitError{Limit: bf.Limit, Size: bf.size + len(b)}
+		}
+		return 0, bf.overflow
+	case bf.committed:
+		n, err = bf.streamWrite(b)
+	case bf.Threshold > 0 && bf.Buffer.Len()+len(b) > bf.Threshold:
+		bf.Flush()
+		n, err = bf.streamWrite(b)
+	default:
+		n, err = bf.Buffer.Write(b)
+	}
+	bf.size += n
+	return
 }
 
-// Reset set the BufferWriter to the defaults
+// streamWrite writes b to the ResponseWriter after the response was
+// committed, dropping it for a HEAD request
+func (bf *BufferWriter) streamWrite(b []byte) (int, error) {
+	if bf.Head {
+		return len(b), nil
+	}
+	return bf.ResponseWriter.Write(b)
+}
+
+// ReadFrom reads src into the underlying buffer and tracks this call
+// as change, after Flush it copies src to the ResponseWriter
+func (bf *BufferWriter) ReadFrom(src io.Reader) (int64, error) {
+	bf.changed = true
+	var n int64
+	var err error
+	switch {
+	case bf.hijacked:
+		return 0, http.ErrHijacked
+	case bf.Threshold > 0 || bf.Limit > 0:
+		return io.Copy(writerOnly{bf}, src)
+	case bf.committed && bf.Head:
+		n, err = io.Copy(io.Discard, src)
+	case bf.committed:
+		n, err = io.Copy(bf.ResponseWriter, src)
+	default:
+		n, err = bf.Buffer.ReadFrom(src)
+	}
+	bf.size += int(n)
+	return n, err
+}
+
+// writerOnly hides ReadFrom so io.Copy writes through the Threshold
+// and Limit checks in Write
+type writerOnly struct {
+	io.Writer
+}
+
+// LimitError is returned by Write when the body would grow past the
+// BufferWriter's Limit
+type LimitError struct {
+	// Limit is the maximum body size
+	Limit int
+
+	// Size is the body size the failed Write would have reached
+	Size int
+}
+
+// Error satisfies the error interface
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("wrap: response body of %d bytes exceeds the %d byte limit", e.Size, e.Limit)
+}
+
+// Overflow returns the first *LimitError returned by Write, nil if
+// the body stayed within Limit
+func (bf *BufferWriter) Overflow() *LimitError {
+	return bf.overflow
+}
+
+// Size returns the number of body bytes written, buffered or
+// streamed after Flush
+func (bf *BufferWriter) Size() int {
+	return bf.size
+}
+
+// Committed returns true once the status code and headers were sent
+// to the ResponseWriter by Flush or by passing Threshold, the
+// response can no longer be replaced
+func (bf *BufferWriter) Committed() bool {
+	return bf.committed
+}
+
+// Flush commits the cached headers, status code and buffered body to
+// the ResponseWriter and flushes it if it is an http.Flusher. From
+// then on the response streams, writes go directly to the
+// ResponseWriter and the status code and headers can't be replaced.
+func (bf *BufferWriter) Flush() {
+	if bf.hijacked {
+		return
+	}
+	bf.changed = true
+	if !bf.committed {
+		bf.FlushHeaders()
+		bf.FlushCode()
+		bf.committed = true
+	}
+	if bf.Buffer.Len() > 0 {
+		bf.streamWrite(bf.Buffer.Bytes())
+		bf.Buffer.Reset()
+	}
+	if flusher, ok := bf.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hijacks the ResponseWriter's connection if nothing was
+// buffered or committed, otherwise it returns ErrBuffered. Cached
+// headers are dropped, after a Hijack FlushAll writes nothing.
+func (bf *BufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := bf.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if bf.committed || bf.Code != 0 || bf.Buffer.Len() > 0 {
+		return nil, nil, ErrBuffered
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		bf.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Reset set the BufferWriter to the defaults, an Overflow is kept
 func (bf *BufferWriter) Reset() {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	bf.size -= bf.Buffer.Len()
 	bf.Buffer.Reset()
 	bf.Code = 0
 	bf.changed = false
@@ -114,14 +383,79 @@ func (bf *BufferWriter) Reset() {
 }
 
 // FlushAll flushes headers, status code and body to the underlying
-// ResponseWriter, if something changed
+// ResponseWriter, if something changed. After Flush only what is
+// left in the buffer is written. With Head the body isn't written.
 func (bf *BufferWriter) FlushAll() {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	switch {
+	case bf.hijacked:
+		return
+	case bf.committed:
+		if bf.Buffer.Len() > 0 {
+			bf.streamWrite(bf.Buffer.Bytes())
+		}
+		return
+	}
 	if bf.HasChanged() {
+		bf.transform()
+		bf.contentHeaders()
 		bf.FlushHeaders()
 		bf.FlushCode()
-		bf.ResponseWriter.Write(bf.Buffer.Bytes())
+		if !bf.Head {
+			bf.ResponseWriter.Write(bf.Buffer.Bytes())
+		}
+	}
+}
+
+// contentHeaders sets Content-Length from the buffered body and a
+// missing Content-Type with http.DetectContentType, before net/http
+// would sniff the first write after the headers were flushed. A HEAD
+// response with nothing buffered keeps the Content-Length its handler
+// declared. In Strict mode a Content-Length set by the handler that
+// doesn't match the body replaces the response with a 500, a HEAD
+// response with nothing buffered isn't checked.
+func (bf *BufferWriter) contentHeaders() {
+	if !bodyAllowed(bf.Code) {
+		return
+	}
+	length := strconv.Itoa(bf.Buffer.Len())
+	headOnly := bf.Head && bf.Buffer.Len() == 0
+	if declared := bf.header.Get("Content-Length"); bf.Strict && !headOnly && declared != "" && declared != length {
+		code := http.StatusInternalServerError
+		bf.Reset()
+		bf.changed = true
+		bf.Code = code
+		bf.header.Set("Content-Type", "text/plain; charset=utf-8")
+		bf.header.Set("X-Content-Type-Options", "nosniff")
+		bf.setBody([]byte(http.StatusText(code) + "\n"))
+		length = strconv.Itoa(bf.Buffer.Len())
+	}
+	if _, typed := bf.header["Content-Type"]; !typed && bf.Buffer.Len() > 0 {
+		bf.header.Set("Content-Type", http.DetectContentType(bf.Buffer.Bytes()))
 	}
+	if headOnly && bf.header.Get("Content-Length") != "" {
+		return
+	}
+	bf.header.Set("Content-Length", length)
+}
+
+// bodyAllowed returns false for the status codes without a body
+func bodyAllowed(code int) bool {
+	switch {
+	case code == 0:
+		return true
+	case code < 200, code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// setBody replaces the buffered body, used by the wrappers rewriting
+// the response before the flush
+func (bf *BufferWriter) setBody(body []byte) {
+	bf.size -= bf.Buffer.Len()
+	bf.Buffer.Reset()
+	bf.Buffer.Write(body)
+	bf.size += len(body)
 }
 
 // Body returns the bytes of the underlying buffer (that is meant to
@@ -133,21 +467,18 @@ func (bf *BufferWriter) Body() []byte {
 // BodyString returns the string of the underlying buffer (that is
 // meant to be the body of the response)
 func (bf *BufferWriter) BodyString() string {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	return bf.Buffer.String()
 }
 
 // HasChanged returns true if Header, WriteHeader or Write has been
 // called
 func (bf *BufferWriter) HasChanged() bool {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	return bf.changed
 }
 
 // IsOk returns true if the cached status code is not set or in the
 // 2xx range.
 func (bf *BufferWriter) IsOk() bool {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	if bf.Code == 0 {
 		return true
 	}
@@ -160,7 +491,6 @@ func (bf *BufferWriter) IsOk() bool {
 // FlushCode flushes the status code to the underlying responsewriter
 // if it was set.
 func (bf *BufferWriter) FlushCode() {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	if bf.Code != 0 {
 		bf.ResponseWriter.WriteHeader(bf.Code)
 	}
@@ -169,7 +499,6 @@ func (bf *BufferWriter) FlushCode() {
 // FlushHeaders adds the headers to the underlying ResponseWriter,
 // removing them from BufferWriter.
 func (bf *BufferWriter) FlushHeaders() {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	header := bf.ResponseWriter.Header()
 	for k, v := range bf.header {
 		header.Del(k)
@@ -0,0 +1,178 @@
+package wrap
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_BufferFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	bf := NewBufferWriter(rec)
+	bf.Header().Set("Content-Type", "text/event-stream")
+	bf.WriteHeader(http.StatusAccepted)
+	bf.Write([]byte("data: 1\n\n"))
+	if rec.Body.Len() != 0 {
+		t.Fatal("body written before Flush")
+	}
+	bf.Flush()
+	if !rec.Flushed || rec.Code != http.StatusAccepted || rec.Body.String() != "data: 1\n\n" ||
+		rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected flush %d %q", rec.Code, rec.Body.String())
+	}
+	io.WriteString(bf, "data: 2\n\n")
+	if rec.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Fatalf("write after Flush not streamed %q", rec.Body.String())
+	}
+	bf.FlushAll()
+	if rec.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Fatalf("FlushAll after Flush rewrote the body %q", rec.Body.String())
+	}
+}
+
+func Test_BufferReadFrom(t *testing.T) {
+	rec := httptest.NewRecorder()
+	bf := NewBufferWriter(rec)
+	if _, err := io.Copy(bf, strings.NewReader("Body Text")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.Len() != 0 || bf.BodyString() != "Body Text" {
+		t.Fatalf("ReadFrom bypassed the buffer %q", rec.Body.String())
+	}
+}
+
+func Test_BufferHijack(t *testing.T) {
+	if _, _, err := NewBufferWriter(httptest.NewRecorder()).Hijack(); err != http.ErrNotSupported {
+		t.Fatalf("unexpected error %v", err)
+	}
+	hijack := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/buffered" {
+			w.Write([]byte("buffered"))
+			if _, _, err := w.(http.Hijacker).Hijack(); err != ErrBuffered {
+				t.Errorf("unexpected error %v", err)
+			}
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 8\r\n\r\nhijacked")
+		rw.Flush()
+	}
+	server := httptest.NewServer(HttpScopedHandlerWriter(http.HandlerFunc(hijack)))
+	defer server.Close()
+	for path, expect := range map[string]string{"/": "hijacked", "/buffered": "buffered"} {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(bufio.NewReader(response.Body))
+		response.Body.Close()
+		if string(body) != expect {
+			t.Errorf("expected %q got %q", expect, body)
+		}
+	}
+}
+
+func Test_BufferThreshold(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var committed []bool
+	handler := HttpScopedStreamHandlerWriter(8)(RecoverWith(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Body"))
+		committed = append(committed, w.(*BufferWriter).Committed())
+		w.Write([]byte(" Text"))
+		committed = append(committed, w.(*BufferWriter).Committed())
+		w.WriteHeader(http.StatusTeapot)
+		panic("after commit")
+	})))
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, Response()) {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if committed[0] || !committed[1] {
+		t.Fatalf("unexpected commits %v", committed)
+	}
+}
+
+func Test_BufferLimit(t *testing.T) {
+	var overflow *LimitError
+	onOverflow := func(r *http.Request, err *LimitError) { overflow = err }
+	var written error
+	runaway := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Body"))
+		_, written = w.Write([]byte(" Text"))
+	}
+	handler := HttpScopedLimitHandlerWriter(8, http.StatusInsufficientStorage, onOverflow)(http.HandlerFunc(runaway))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	text := http.StatusText(http.StatusInsufficientStorage) + "\n"
+	if rec.Code != http.StatusInsufficientStorage || rec.Body.String() != text {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if overflow == nil || written != overflow || overflow.Limit != 8 || overflow.Size != 9 {
+		t.Fatalf("unexpected overflow %v %v", overflow, written)
+	}
+
+	rec = httptest.NewRecorder()
+	HttpScopedLimitHandlerWriter(9, http.StatusInsufficientStorage, nil)(http.HandlerFunc(runaway)).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, Response()) || written != nil {
+		t.Fatalf("unexpected response %d %q %v", rec.Code, rec.Body.String(), written)
+	}
+
+	var copied error
+	gap := func(w http.ResponseWriter, r *http.Request) {
+		runaway(w, r)
+		_, written = w.Write([]byte("!"))
+		_, copied = io.Copy(w, strings.NewReader("!"))
+	}
+	HttpScopedLimitHandlerWriter(8, http.StatusInsufficientStorage, onOverflow)(http.HandlerFunc(gap)).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if written != overflow || copied != overflow {
+		t.Fatalf("write after the overflow %v %v", written, copied)
+	}
+}
+
+func Test_BufferContentHeaders(t *testing.T) {
+	html := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html><body>Body Text</body></html>")
+	}
+	rec := httptest.NewRecorder()
+	HttpScopedHandlerWriter(http.HandlerFunc(html)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("Content-Type") != "text/html; charset=utf-8" || rec.Header().Get("Content-Length") != "35" {
+		t.Fatalf("unexpected headers %v", rec.Header())
+	}
+
+	wrong := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4")
+		a(w, r)
+	}
+	rec = httptest.NewRecorder()
+	HttpScopedHandlerWriter(http.HandlerFunc(wrong)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, Response()) || rec.Header().Get("Content-Length") != "9" {
+		t.Fatalf("unexpected response %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	rec = httptest.NewRecorder()
+	HttpScopedStrictHandlerWriter(http.HandlerFunc(wrong)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, ErrorResponse()) {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	head := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "9")
+		if r.Method != http.MethodHead {
+			a(w, r)
+		}
+	}
+	rec = httptest.NewRecorder()
+	HttpScopedStrictHandlerWriter(http.HandlerFunc(head)).ServeHTTP(rec, httptest.NewRequest("HEAD", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "9" {
+		t.Fatalf("unexpected HEAD response %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
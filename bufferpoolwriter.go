@@ -4,28 +4,47 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	trace "github.com/davidwalter0/tracer"
-	"github.com/oxtoacart/bpool"
 )
 
-var detail = false
-var enable = false
-var BP *bpool.SizedBufferPool
+// detail and enable are the TracerSpans console trace toggles, safe to
+// flip while serving
+var detail, enable atomic.Bool
+var BP Pool
+var bpMu sync.Mutex
+
+// BPSize was the number of buffers the default pool kept, the default
+// SyncPool isn't bounded by a count.
+//
+// Deprecated: BufferPool() ignores BPSize, for a bounded default set
+// BP = NewSizedPool(BPSize, BPAlloc) before serving.
 var BPSize = 32
+
 var BPAlloc = 16384
+var BPMax = 65536
 
 var tracer *trace.Tracer
 
-// turn on call trace for debug and testing
+// turn on call trace for debug and testing, WRAP_BUFFER_TRACE_ENABLE
+// enables the trace and WRAP_BUFFER_TRACE_DETAIL its detail
 func TraceEnvConfig() bool {
-	switch strings.ToLower(os.Getenv("WRAP_BUFFER_TRACE_ENABLE")) {
+	SetTraceDetail(envOn("WRAP_BUFFER_TRACE_DETAIL"))
+	return EnableTrace(envOn("WRAP_BUFFER_TRACE_ENABLE"))
+}
+
+// envOn returns true when the environment variable name is set to an
+// affirmative value like true, on or 1
+func envOn(name string) bool {
+	switch strings.ToLower(os.Getenv(name)) {
 	case "enable", "true", "1", "ok", "ack", "on", "yes":
-		return EnableTrace(true)
+		return true
 	case "disable", "false", "0", "nak", "off", "no":
 		fallthrough
 	default:
-		return EnableTrace(false)
+		return false
 	}
 }
 
@@ -37,14 +56,27 @@ func Tracer() *trace.Tracer {
 	return tracer
 }
 
+// EnableTrace turns the TracerSpans console trace on or off, safe for
+// concurrent use
 func EnableTrace(e bool) bool {
-	enable = e
+	enable.Store(e)
 	return e
 }
 
-func BufferPool() *bpool.SizedBufferPool {
+// SetTraceDetail turns the detail of the TracerSpans console trace on
+// or off, safe for concurrent use
+func SetTraceDetail(d bool) bool {
+	detail.Store(d)
+	return d
+}
+
+// BufferPool returns the package buffer pool BP, creating a SyncPool
+// from BPAlloc and BPMax on first use, safe for concurrent use
+func BufferPool() Pool {
+	bpMu.Lock()
+	defer bpMu.Unlock()
 	if BP == nil {
-		BP = bpool.NewSizedBufferPool(BPSize, BPAlloc)
+		BP = NewSyncPool(BPAlloc, BPMax)
 	}
 	return BP
 }
@@ -52,22 +84,37 @@ func BufferPool() *bpool.SizedBufferPool {
 // NewBufferPoolWriter returns a BufferWriter wrapping the given
 // response writer.
 func NewBufferPoolWriter(w http.ResponseWriter) (bf *BufferWriter) {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	return NewPoolWriter(w, BufferPool())
+}
+
+// NewPoolWriter returns a BufferWriter wrapping the given response
+// writer with a buffer from pool, BPFlushAll returns the buffer to
+// pool.
+func NewPoolWriter(w http.ResponseWriter, pool Pool) (bf *BufferWriter) {
 	bf = &BufferWriter{}
 	bf.ResponseWriter = w
 	bf.header = make(http.Header)
-	bf.Buffer = BufferPool().Get()
+	bf.pool = pool
+	bf.Buffer = pool.Get()
 	return
 }
 
-// FlushAll flushes headers, status code and body to the underlying
-// ResponseWriter, if something changed
+// BPFlushAll flushes headers, status code and body to the underlying
+// ResponseWriter like FlushAll, then returns the buffer to the pool
+// whether or not something changed. The BufferWriter must not be
+// written to afterwards.
 func (bf *BufferWriter) BPFlushAll() {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
-	if bf.HasChanged() {
-		bf.FlushHeaders()
-		bf.FlushCode()
-		bf.ResponseWriter.Write(bf.Buffer.Bytes())
-		BufferPool().Put(bf.Buffer)
+	if bf.Buffer == nil {
+		return
+	}
+	defer bf.bpRelease()
+	bf.FlushAll()
+}
+
+// bpRelease returns the buffer to the pool once, without flushing
+func (bf *BufferWriter) bpRelease() {
+	if bf.Buffer != nil && bf.pool != nil {
+		bf.pool.Put(bf.Buffer)
+		bf.Buffer = nil
 	}
 }
@@ -0,0 +1,153 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// pooled swaps in a single buffer pool holding buffer for the test
+func pooled(t *testing.T) *bytes.Buffer {
+	saved := BP
+	t.Cleanup(func() { BP = saved })
+	BP = NewSizedPool(1, BPAlloc)
+	b := BP.Get()
+	BP.Put(b)
+	return b
+}
+
+func Test_BufferPoolReturn(t *testing.T) {
+	tests := map[string]http.Handler{
+		"empty":   HttpScopedBPHandlerWriter(NoOp),
+		"written": HttpScopedBPHandlerWriter(A),
+		"panic":   RecoverWith(nil)(HttpScopedBPHandlerWriter(http.HandlerFunc(failer))),
+	}
+	for name, handler := range tests {
+		buffer := pooled(t)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if BP.Get() != buffer {
+			t.Errorf("%s: buffer not returned to the pool", name)
+		}
+	}
+}
+
+func Test_BufferPoolConcurrent(t *testing.T) {
+	saved := BP
+	defer func() { BP = saved }()
+	BP = nil
+	handler := HttpScopedBPHandlerWriter(ChainLinkWrap(Recover, x, a))
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if !compare(rec, Response()) {
+				t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// countingPool records the buffers handed out and returned
+type countingPool struct {
+	gets, puts int
+}
+
+func (p *countingPool) Get() *bytes.Buffer { p.gets++; return &bytes.Buffer{} }
+func (p *countingPool) Put(*bytes.Buffer)  { p.puts++ }
+
+func Test_BufferPoolPerRoute(t *testing.T) {
+	left, right := &countingPool{}, &countingPool{}
+	handlers := []http.Handler{
+		HttpScopedPoolHandlerWriter(left)(A),
+		HttpScopedPoolHandlerWriter(right)(A),
+		HttpScopedPoolHandlerWriter(right)(NoOp),
+	}
+	for _, handler := range handlers {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if left.gets != 1 || left.puts != 1 || right.gets != 2 || right.puts != 2 {
+		t.Fatalf("unexpected pool use %+v %+v", left, right)
+	}
+}
+
+func Test_SyncPoolDropsOversized(t *testing.T) {
+	pool := NewSyncPool(16, 64)
+	b := pool.Get()
+	if b.Cap() != 16 {
+		t.Fatalf("unexpected capacity %d", b.Cap())
+	}
+	b.Write(make([]byte, 128))
+	pool.Put(b)
+	if got := pool.Get(); got == b || got.Cap() != 16 {
+		t.Fatalf("oversized buffer retained %d", got.Cap())
+	}
+}
+
+func Test_PoolStats(t *testing.T) {
+	for name, pool := range map[string]StatsPool{"sync": NewSyncPool(16, 64), "sized": NewSizedPool(4, 16)} {
+		b := pool.Get()
+		b.Write(make([]byte, 128))
+		pool.Put(b)
+		pool.Put(pool.Get())
+		stats := pool.Stats()
+		if stats.Gets != 2 || stats.Puts != 2 || stats.Discards != 1 || stats.HighWater < 128 ||
+			stats.Misses < 1 || stats.Misses > 2 {
+			t.Errorf("%s: unexpected stats %+v", name, stats)
+		}
+	}
+	sized := NewSizedPool(4, 16)
+	sized.Put(sized.Get())
+	sized.Get()
+	if stats := sized.Stats(); stats.Misses != 1 {
+		t.Errorf("sized: unexpected misses %+v", stats)
+	}
+}
+
+func Test_PoolExpvar(t *testing.T) {
+	saved := BP
+	defer func() { BP = saved }()
+	BP = NewSyncPool(16, 64)
+	if expvar.Get("wrap.pool") == nil {
+		PublishPoolStats("wrap.pool")
+	}
+	HttpScopedBPHandlerWriter(A).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	var stats PoolStats
+	if err := json.Unmarshal([]byte(expvar.Get("wrap.pool").String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Gets != 1 || stats.Puts != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func Test_AdaptivePool(t *testing.T) {
+	pool := NewAdaptivePool(0.5, 8, 4)
+	route := pool.Route("/route")
+	if pool.Route("/route") != route || route.Alloc() != BPAlloc {
+		t.Fatalf("unexpected route pool %d", route.Alloc())
+	}
+	body := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	})
+	handler := HttpScopedPoolHandlerWriter(route)(body)
+	for i := 0; i < 8; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/route", nil))
+	}
+	if route.Alloc() != 1000 || pool.Alloc() != BPAlloc {
+		t.Fatalf("unexpected allocation %d %d", route.Alloc(), pool.Alloc())
+	}
+	before := route.Stats()
+	route.Put(bytes.NewBuffer(make([]byte, 0, 8000)))
+	if stats := route.Stats(); stats.Discards != before.Discards+1 || stats.Puts != 9 {
+		t.Fatalf("oversized buffer retained %+v", stats)
+	}
+}
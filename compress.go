@@ -0,0 +1,210 @@
+package wrap
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressTypes are the Content-Type prefixes Compression compresses
+var CompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// Encoder compresses a buffered body for one content coding
+type Encoder interface {
+	// Encoding is the Content-Encoding token, like gzip
+	Encoding() string
+
+	// Encode writes body compressed to dst
+	Encode(dst io.Writer, body []byte) error
+}
+
+// writerEncoder is an Encoder built from a compressing io.WriteCloser
+type writerEncoder struct {
+	encoding string
+	writer   func(io.Writer) (io.WriteCloser, error)
+}
+
+func (e writerEncoder) Encoding() string {
+	return e.encoding
+}
+
+func (e writerEncoder) Encode(dst io.Writer, body []byte) error {
+	w, err := e.writer(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// NewEncoder returns an Encoder for encoding compressing with the
+// writers returned by writer, for codings outside the standard
+// library like br
+func NewEncoder(encoding string, writer func(io.Writer) (io.WriteCloser, error)) Encoder {
+	return writerEncoder{encoding: encoding, writer: writer}
+}
+
+// GzipEncoder returns the gzip Encoder for a compress/gzip level
+func GzipEncoder(level int) Encoder {
+	return NewEncoder("gzip", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	})
+}
+
+// DeflateEncoder returns the deflate Encoder for a compress/flate
+// level
+func DeflateEncoder(level int) Encoder {
+	return NewEncoder("deflate", func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+}
+
+// Compression returns a ChainerFunc buffering the wrapped handler and
+// compressing the body at flush time. The final Content-Type, set by
+// the handler or sniffed from the body, must match CompressTypes and
+// the body must be at least minSize bytes. The encoder is chosen from
+// Accept-Encoding, ties going to the earlier encoder, with gzip and
+// deflate as the default encoders. The body is only replaced when
+// compression makes it smaller, Content-Encoding, Content-Length and
+// Vary are set to match and a strong ETag is weakened. A partial
+// response, a 206 or one with Content-Range, is left as is, its
+// ranges index the unencoded body. When the handler panics nothing
+// is flushed, the partial response is dropped so an outer Recover
+// can answer.
+func Compression(minSize int, encoders ...Encoder) ChainerFunc {
+	if len(encoders) == 0 {
+		encoders = []Encoder{GzipEncoder(gzip.DefaultCompression), DeflateEncoder(flate.DefaultCompression)}
+	}
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buffer := NewRequestBufferWriter(w, r)
+			r, span := startSpan(r, "wrap.Compression")
+			defer endBufferSpan(span, buffer)
+			handler.ServeHTTP(buffer, r)
+			compress(buffer, r, minSize, encoders)
+			buffer.FlushAll()
+		})
+	}
+}
+
+// compress replaces the buffered body with its encoding when that
+// pays off
+func compress(bf *BufferWriter, r *http.Request, minSize int, encoders []Encoder) {
+	if bf.committed || bf.hijacked || !bf.HasChanged() {
+		return
+	}
+	header := bf.header
+	if header.Get("Content-Encoding") != "" || !bodyAllowed(bf.Code) {
+		return
+	}
+	if bf.Code == http.StatusPartialContent || header.Get("Content-Range") != "" {
+		return
+	}
+	body := bf.Buffer.Bytes()
+	contentType := header.Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+		header.Set("Content-Type", contentType)
+	}
+	if !compressible(contentType) {
+		return
+	}
+	if !headerHasToken(header, "Vary", "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if len(body) < minSize {
+		return
+	}
+	encoder := acceptEncoder(r.Header.Get("Accept-Encoding"), encoders)
+	if encoder == nil {
+		return
+	}
+	var compressed bytes.Buffer
+	if err := encoder.Encode(&compressed, body); err != nil || compressed.Len() >= len(body) {
+		return
+	}
+	bf.setBody(compressed.Bytes())
+	header.Set("Content-Encoding", encoder.Encoding())
+	header.Set("Content-Length", strconv.Itoa(compressed.Len()))
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// headerHasToken returns true if a comma separated value of key in
+// header is token
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressible matches contentType against CompressTypes
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range CompressTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptEncoder returns the encoder with the highest Accept-Encoding
+// quality, nil when none is acceptable
+func acceptEncoder(accept string, encoders []Encoder) Encoder {
+	var chosen Encoder
+	var best float64
+	for _, encoder := range encoders {
+		if q := acceptQuality(accept, encoder.Encoding()); q > best {
+			chosen, best = encoder, q
+		}
+	}
+	return chosen
+}
+
+// acceptQuality returns the quality of coding in an Accept-Encoding
+// header, an explicit coding taking precedence over *
+func acceptQuality(accept, coding string) float64 {
+	quality, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case coding:
+			quality = q
+		case "*":
+			wildcard = q
+		}
+	}
+	if quality < 0 {
+		quality = wildcard
+	}
+	return quality
+}
@@ -0,0 +1,75 @@
+package wrap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_Compression(t *testing.T) {
+	text := strings.Repeat("Body Text ", 200)
+	handler := func(contentType, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			io.WriteString(w, body)
+		})
+	}
+	tests := []struct {
+		accept, contentType, body, encoding string
+	}{
+		{"gzip, deflate", "", text, "gzip"},
+		{"deflate, gzip;q=0.5", "application/json", text, "deflate"},
+		{"gzip;q=0, *", "text/html", text, "deflate"},
+		{"gzip", "", "Body Text", ""},
+		{"gzip", "image/png", text, ""},
+		{"", "", text, ""},
+		{"br", "", text, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", test.accept)
+		rec := httptest.NewRecorder()
+		Compression(1024)(handler(test.contentType, test.body)).ServeHTTP(rec, req)
+		encoding := rec.Header().Get("Content-Encoding")
+		if encoding != test.encoding {
+			t.Errorf("%q %q: expected encoding %q got %q", test.accept, test.contentType, test.encoding, encoding)
+			continue
+		}
+		if length := rec.Header().Get("Content-Length"); encoding != "" && length != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%q: Content-Length %s for %d bytes", test.accept, length, rec.Body.Len())
+		}
+		if test.contentType != "image/png" && rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q: missing Vary", test.accept)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	Compression(0)(handler("", text)).ServeHTTP(rec, req)
+	reader, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(reader)
+	if string(body) != text || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-999")
+	rec = httptest.NewRecorder()
+	Compression(0)(Ranges(handler("", text))).ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Header().Get("Content-Encoding") != "" ||
+		rec.Header().Get("Content-Range") != "bytes 0-999/2000" || rec.Body.String() != text[:1000] {
+		t.Fatalf("unexpected partial response %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+}
@@ -0,0 +1,75 @@
+package wrap
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ContextHandlerFunc is a context aware chain link. ctx is the
+// request context, the returned context, when not nil, is attached
+// to the request handed to the next link. In ChainContext r also
+// carries the link's span, ctx doesn't so the span isn't passed on.
+type ContextHandlerFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context
+
+// ServeHTTP satisfies the http.Handler interface, the returned
+// context is dropped
+func (fn ContextHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fn(r.Context(), w, r)
+}
+
+// ContextLink adapts an http.Handler to a ContextHandlerFunc that
+// passes the request context through unchanged
+func ContextLink(handler http.Handler) ContextHandlerFunc {
+	name := HandlerName(handler)
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+		nameLink(r, name)
+		handler.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+// WithValue returns a link deriving a context carrying value for key
+func WithValue(key, value interface{}) ContextHandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+		return context.WithValue(ctx, key, value)
+	}
+}
+
+// WithTimeout returns a link deriving a context that is cancelled
+// after dt or when the chain ends
+func WithTimeout(dt time.Duration) ContextHandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+		derived, cancel := context.WithTimeout(ctx, dt)
+		context.AfterFunc(ctx, cancel)
+		return derived
+	}
+}
+
+// ChainContext creates an ordered chain of context aware handlers.
+// Each link receives the context returned by the previous link in
+// the request it is handed, the chain's context is cancelled when
+// the last link returns, releasing any derived deadlines.
+// The handlers call chain A->B->C => A(ctx)->B(A's ctx)->C(B's ctx)
+func ChainContext(handlers ...ContextHandlerFunc) http.Handler {
+	if len(handlers) == 0 {
+		return NoOp
+	}
+	names := make([]string, len(handlers))
+	for i, handler := range handlers {
+		names[i] = HandlerName(handler)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		r = r.WithContext(ctx)
+		for i, handler := range handlers {
+			lr, span := startLinkSpan(r, names[i], i)
+			derived := handler(r.Context(), w, lr)
+			span.End()
+			if derived != nil && derived != r.Context() {
+				r = r.WithContext(derived)
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package wrap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type userKey struct{}
+
+func Test_ChainContext(t *testing.T) {
+	var user interface{}
+	var deadline bool
+	var done <-chan struct{}
+	handler := ChainContext(
+		WithValue(userKey{}, "user"),
+		WithTimeout(time.Minute),
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+			user = r.Context().Value(userKey{})
+			_, deadline = ctx.Deadline()
+			done = ctx.Done()
+			return nil
+		},
+		ContextLink(A))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if user != "user" || !deadline {
+		t.Fatalf("context not passed down the chain %v %v", user, deadline)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("chain context not cancelled after the chain ended")
+	}
+	if rec.Body.String() != "Body Text" {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,91 @@
+package wrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag returns a ChainerFunc buffering the wrapped handler and, for
+// GET and HEAD requests answered with a 200, setting an ETag hashed
+// from the buffered body unless the handler set one. weak selects a
+// W/ prefixed weak validator. When the ETag matches If-None-Match,
+// or without If-None-Match when Last-Modified isn't after
+// If-Modified-Since, a 304 is flushed without a body. Wrapping
+// Compression with ETag hashes the encoded body, so each encoding
+// gets its own ETag. A panicking handler's response isn't flushed.
+func ETag(weak bool) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buffer := NewRequestBufferWriter(w, r)
+			r, span := startSpan(r, "wrap.ETag")
+			defer endBufferSpan(span, buffer)
+			handler.ServeHTTP(buffer, r)
+			conditional(buffer, r, weak)
+			buffer.FlushAll()
+		})
+	}
+}
+
+// conditional sets the ETag and replaces the response with a 304 when
+// the request's validators match
+func conditional(bf *BufferWriter, r *http.Request, weak bool) {
+	if bf.committed || bf.hijacked || !bf.HasChanged() {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return
+	}
+	if bf.Code != 0 && bf.Code != http.StatusOK {
+		return
+	}
+	header := bf.header
+	etag := header.Get("ETag")
+	if etag == "" {
+		sum := sha256.Sum256(bf.Buffer.Bytes())
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		if weak {
+			etag = "W/" + etag
+		}
+		header.Set("ETag", etag)
+	}
+	if !notModified(header, r, etag) {
+		return
+	}
+	bf.setBody(nil)
+	bf.Code = http.StatusNotModified
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when
+// If-None-Match is absent
+func notModified(header http.Header, r *http.Request, etag string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, etag)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
+
+// etagMatch reports whether etag matches a weak comparison against
+// the comma separated list of an If-None-Match or If-Range header
+func etagMatch(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
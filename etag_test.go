@@ -0,0 +1,53 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_ETag(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ETag(false)(A).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	etag := rec.Header().Get("ETag")
+	if !compare(rec, Response()) || len(etag) != 34 {
+		t.Fatalf("unexpected response %d %q %q", rec.Code, rec.Body.String(), etag)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"other", W/`+etag)
+	rec = httptest.NewRecorder()
+	ETag(false)(A).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	req.Header.Set("If-None-Match", `"other"`)
+	rec = httptest.NewRecorder()
+	ETag(true)(A).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != "W/"+etag {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func Test_ETagModifiedSince(t *testing.T) {
+	modified := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := ETag(false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		a(w, r)
+	}))
+	for since, code := range map[time.Time]int{
+		modified:                 http.StatusNotModified,
+		modified.Add(time.Hour):  http.StatusNotModified,
+		modified.Add(-time.Hour): http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("If-Modified-Since", since.Format(http.TimeFormat))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%v: expected %d got %d", since, code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package wrap
+
+import "net/http"
+
+// HeadAsGet serves a HEAD request with a GET handler, the handler
+// sees a GET request and writes to a BufferWriter in Head mode, so
+// the headers, status code and Content-Length match the GET response
+// without sending the body. Wrapped by another Buffer the body is
+// passed on for it to drop. Other methods pass through. A panicking
+// handler's response isn't flushed.
+func HeadAsGet(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		buffer := NewBufferWriter(w)
+		buffer.Head = headWriter(w, r)
+		get, span := startSpan(get, "wrap.HeadAsGet")
+		defer endBufferSpan(span, buffer)
+		handler.ServeHTTP(buffer, get)
+		buffer.FlushAll()
+	})
+}
@@ -0,0 +1,78 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Head(t *testing.T) {
+	getOnly := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a(w, r)
+	})
+	tests := map[string]http.Handler{
+		"buffer": HttpScopedHandlerWriter(A),
+		"pool":   HttpScopedBPHandlerWriter(A),
+		"stream": HttpScopedStreamHandlerWriter(4)(A),
+		"get":    HeadAsGet(getOnly),
+	}
+	for name, handler := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("HEAD", "/", nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Errorf("%s: unexpected response %d %q", name, rec.Code, rec.Body.String())
+		}
+		if name != "stream" && rec.Header().Get("Content-Length") != "9" {
+			t.Errorf("%s: unexpected Content-Length %q", name, rec.Header().Get("Content-Length"))
+		}
+	}
+	rec := httptest.NewRecorder()
+	HeadAsGet(getOnly).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, Response()) {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func Test_HeadStacked(t *testing.T) {
+	text := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("compressible text ", 20)))
+	})
+	content := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "hello.txt", time.Time{}, strings.NewReader("hello world"))
+	})
+	tests := map[string]http.Handler{
+		"compress etag": Compression(0)(ETag(false)(text)),
+		"ranges etag":   Ranges(ETag(false)(text)),
+		"buffer head":   HttpScopedHandlerWriter(HeadAsGet(text)),
+		"serve content": HttpScopedHandlerWriter(content),
+		"pool content":  HttpScopedBPHandlerWriter(content),
+	}
+	for name, handler := range tests {
+		get := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(get, req)
+		head := httptest.NewRecorder()
+		req = httptest.NewRequest("HEAD", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(head, req)
+		if head.Body.Len() != 0 || head.Code != get.Code {
+			t.Errorf("%s: unexpected HEAD response %d %q", name, head.Code, head.Body.String())
+		}
+		for _, key := range []string{"Content-Length", "Content-Encoding", "ETag"} {
+			if head.Header().Get(key) != get.Header().Get(key) {
+				t.Errorf("%s: HEAD %s %q, GET %q", name, key, head.Header().Get(key), get.Header().Get(key))
+			}
+		}
+		if get.Header().Get("Content-Length") != strconv.Itoa(get.Body.Len()) {
+			t.Errorf("%s: unexpected GET Content-Length %q", name, get.Header().Get("Content-Length"))
+		}
+	}
+}
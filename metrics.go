@@ -0,0 +1,227 @@
+package wrap
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the latency
+// histogram buckets used when NewMetrics is given none
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are the upper bounds in bytes of the response
+// size histogram buckets used when NewMetrics is given none
+var DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1e6, 1e7}
+
+// Metrics records request counts, latency and response size
+// histograms and in-flight requests of the routes it wraps, and
+// exposes them with the BufferPool() stats and the Recover panic
+// count in the Prometheus text exposition format
+type Metrics struct {
+	latencyBuckets []float64
+	sizeBuckets    []float64
+	inFlight       int64
+
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	latency  map[string]*histogram
+	sizes    map[string]*histogram
+}
+
+// requestKey labels the request counter
+type requestKey struct {
+	method, route string
+	code          int
+}
+
+// histogram counts observations per bucket, the last count is +Inf
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(buckets []float64, value float64) {
+	i := sort.SearchFloat64s(buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// NewMetrics returns Metrics with the latency buckets in seconds and
+// the size buckets in bytes, nil for DefaultLatencyBuckets and
+// DefaultSizeBuckets
+func NewMetrics(latencyBuckets, sizeBuckets []float64) *Metrics {
+	if latencyBuckets == nil {
+		latencyBuckets = DefaultLatencyBuckets
+	}
+	if sizeBuckets == nil {
+		sizeBuckets = DefaultSizeBuckets
+	}
+	latencyBuckets = append([]float64(nil), latencyBuckets...)
+	sizeBuckets = append([]float64(nil), sizeBuckets...)
+	sort.Float64s(latencyBuckets)
+	sort.Float64s(sizeBuckets)
+	return &Metrics{
+		latencyBuckets: latencyBuckets,
+		sizeBuckets:    sizeBuckets,
+		requests:       make(map[requestKey]int64),
+		latency:        make(map[string]*histogram),
+		sizes:          make(map[string]*histogram),
+	}
+}
+
+// Route returns a ChainerFunc recording the requests of the wrapped
+// handler under the route label name. Like AccessLog the status code
+// and body size are read from the BufferWriter the handler wrote to,
+// so the size is the buffered body, 0 for a HEAD response. Route
+// flushes its own BufferWriter before recording, a BufferWriter
+// passed in is read before its owner flushes it, so its transformers
+// and Strict check aren't reflected. A panic is recorded as a 500 and
+// passed on unflushed to an outer Recover.
+func (m *Metrics) Route(name string) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&m.inFlight, 1)
+			defer atomic.AddInt64(&m.inFlight, -1)
+			start := time.Now()
+			r, span := startSpan(r, "wrap.Metrics")
+			defer span.End()
+			buffer, ok := w.(*BufferWriter)
+			if !ok {
+				buffer = NewRequestBufferWriter(w, r)
+			}
+			completed := false
+			defer func() {
+				if completed && !ok {
+					buffer.FlushAll()
+				}
+				entry := accessEntry(buffer, r, start, completed)
+				m.observe(r.Method, name, entry.Code, entry.Duration, entry.Size)
+			}()
+			handler.ServeHTTP(buffer, r)
+			completed = true
+		})
+	}
+}
+
+// observe records a request of route
+func (m *Metrics) observe(method, route string, code int, duration time.Duration, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method: method, route: route, code: code}]++
+	latency, ok := m.latency[route]
+	if !ok {
+		latency = &histogram{counts: make([]int64, len(m.latencyBuckets)+1)}
+		m.latency[route] = latency
+	}
+	latency.observe(m.latencyBuckets, duration.Seconds())
+	sizes, ok := m.sizes[route]
+	if !ok {
+		sizes = &histogram{counts: make([]int64, len(m.sizeBuckets)+1)}
+		m.sizes[route] = sizes
+	}
+	sizes.observe(m.sizeBuckets, float64(size))
+}
+
+// Handler returns a handler serving the metrics in the Prometheus
+// text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var out bytes.Buffer
+		m.write(&out)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(out.Bytes())
+	})
+}
+
+// write writes the metrics to out in the Prometheus text exposition
+// format
+func (m *Metrics) write(out *bytes.Buffer) {
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	metricHeader(out, "wrap_http_requests_total", "counter", "Requests served by method, route and status code.")
+	for _, key := range keys {
+		fmt.Fprintf(out, "wrap_http_requests_total{method=%s,route=%s,code=\"%d\"} %d\n",
+			labelValue(key.method), labelValue(key.route), key.code, m.requests[key])
+	}
+	writeHistograms(out, "wrap_http_request_duration_seconds", "Request latency by route.", m.latencyBuckets, m.latency)
+	writeHistograms(out, "wrap_http_response_size_bytes", "Buffered response body size by route.", m.sizeBuckets, m.sizes)
+	m.mu.Unlock()
+
+	metricHeader(out, "wrap_http_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(out, "wrap_http_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+	metricHeader(out, "wrap_panics_total", "counter", "Panics recovered by Recover.")
+	fmt.Fprintf(out, "wrap_panics_total %d\n", Panics())
+	if stats, ok := BufferPoolStats(); ok {
+		for _, metric := range []struct {
+			name, kind, help string
+			value            int64
+		}{
+			{"wrap_pool_gets_total", "counter", "Buffers handed out by BufferPool.", stats.Gets},
+			{"wrap_pool_puts_total", "counter", "Buffers returned to BufferPool.", stats.Puts},
+			{"wrap_pool_misses_total", "counter", "BufferPool gets allocating a new buffer.", stats.Misses},
+			{"wrap_pool_discards_total", "counter", "Buffers BufferPool dropped for their size.", stats.Discards},
+			{"wrap_pool_high_water_bytes", "gauge", "Largest capacity of a buffer returned to BufferPool.", stats.HighWater},
+		} {
+			metricHeader(out, metric.name, metric.kind, metric.help)
+			fmt.Fprintf(out, "%s %d\n", metric.name, metric.value)
+		}
+	}
+}
+
+// metricHeader writes the HELP and TYPE lines of a metric
+func metricHeader(out *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeHistograms writes a histogram per route with cumulative
+// buckets
+func writeHistograms(out *bytes.Buffer, name, help string, buckets []float64, histograms map[string]*histogram) {
+	metricHeader(out, name, "histogram", help)
+	routes := make([]string, 0, len(histograms))
+	for route := range histograms {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := histograms[route]
+		label := labelValue(route)
+		var cumulative int64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(buckets) {
+				le = strconv.FormatFloat(buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(out, "%s_bucket{route=%s,le=%q} %d\n", name, label, le, cumulative)
+		}
+		fmt.Fprintf(out, "%s_sum{route=%s} %s\n", name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(out, "%s_count{route=%s} %d\n", name, label, h.count)
+	}
+}
+
+// labelValue quotes a label value escaping backslash, double quote
+// and newline
+func labelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,53 @@
+package wrap
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Metrics(t *testing.T) {
+	metrics := NewMetrics([]float64{1}, []float64{10, 100})
+	handler := HttpScopedHandlerWriter(metrics.Route("chain")(Recover(Chain(a, failer))))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	rec := httptest.NewRecorder()
+	metrics.Route("a")(A).ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if !compare(rec, Response()) {
+		t.Fatalf("unexpected response %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`wrap_http_requests_total{method="GET",route="chain",code="500"} 2`,
+		`wrap_http_requests_total{method="POST",route="a",code="200"} 1`,
+		`wrap_http_request_duration_seconds_bucket{route="chain",le="+Inf"} 2`,
+		`wrap_http_request_duration_seconds_count{route="a"} 1`,
+		`wrap_http_response_size_bytes_bucket{route="a",le="10"} 1`,
+		`wrap_http_response_size_bytes_bucket{route="chain",le="10"} 0`,
+		`wrap_http_response_size_bytes_bucket{route="chain",le="100"} 2`,
+		`wrap_http_response_size_bytes_sum{route="chain"} 44`,
+		"wrap_http_requests_in_flight 0",
+		"# TYPE wrap_panics_total counter",
+		"# TYPE wrap_pool_gets_total counter",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+	if Panics() < 2 {
+		t.Errorf("unexpected panic count %d", Panics())
+	}
+}
+
+func Test_LabelValue(t *testing.T) {
+	if got := labelValue("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("unexpected label %s", got)
+	}
+}
@@ -0,0 +1,200 @@
+package wrap
+
+import (
+	"bytes"
+	"expvar"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oxtoacart/bpool"
+)
+
+// Pool is a pool of the buffers used by the pooled buffer writers
+type Pool interface {
+	// Get returns an empty buffer from the pool or a new one
+	Get() *bytes.Buffer
+
+	// Put returns a buffer to the pool, the pool may drop it
+	Put(*bytes.Buffer)
+}
+
+// PoolStats is a snapshot of the counters of a pool
+type PoolStats struct {
+	// Gets is the number of buffers handed out
+	Gets int64
+
+	// Puts is the number of buffers returned
+	Puts int64
+
+	// Misses is the number of Gets allocating a new buffer
+	Misses int64
+
+	// Discards is the number of returned buffers dropped for their size
+	Discards int64
+
+	// HighWater is the largest capacity of a returned buffer
+	HighWater int64
+}
+
+// StatsPool is a Pool keeping PoolStats
+type StatsPool interface {
+	Pool
+	Stats() PoolStats
+}
+
+// SyncPool, SizedPool and AdaptivePool keep PoolStats
+var (
+	_ StatsPool = (*SyncPool)(nil)
+	_ StatsPool = (*SizedPool)(nil)
+	_ StatsPool = (*AdaptivePool)(nil)
+)
+
+// BufferPoolStats returns the PoolStats of BufferPool(), false if the
+// pool doesn't keep them. PublishPoolStats publishes the same
+// snapshot with expvar.
+func BufferPoolStats() (PoolStats, bool) {
+	if pool, ok := BufferPool().(StatsPool); ok {
+		return pool.Stats(), true
+	}
+	return PoolStats{}, false
+}
+
+// PublishPoolStats publishes BufferPoolStats() with expvar as name,
+// served on /debug/vars once expvar is imported. Like expvar.Publish
+// it panics when name is already published, so call it once, e.g.
+// PublishPoolStats("wrap.pool") in main.
+func PublishPoolStats(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		stats, _ := BufferPoolStats()
+		return stats
+	}))
+}
+
+// poolCounters are the PoolStats counters, safe for concurrent use
+type poolCounters struct {
+	gets, puts, misses, discards, highWater atomic.Int64
+}
+
+// get counts a Get, miss when a buffer was allocated
+func (c *poolCounters) get(miss bool) {
+	c.gets.Add(1)
+	if miss {
+		c.misses.Add(1)
+	}
+}
+
+// put counts a Put of b before it is reset, discard when b is dropped
+// for its size
+func (c *poolCounters) put(b *bytes.Buffer, discard bool) {
+	c.puts.Add(1)
+	if discard {
+		c.discards.Add(1)
+	}
+	capacity := int64(b.Cap())
+	for {
+		high := c.highWater.Load()
+		if capacity <= high || c.highWater.CompareAndSwap(high, capacity) {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters
+func (c *poolCounters) Stats() PoolStats {
+	return PoolStats{
+		Gets:      c.gets.Load(),
+		Puts:      c.puts.Load(),
+		Misses:    c.misses.Load(),
+		Discards:  c.discards.Load(),
+		HighWater: c.highWater.Load(),
+	}
+}
+
+// SyncPool is a Pool built on sync.Pool, new buffers are allocated
+// with alloc capacity and buffers grown past max capacity are dropped
+// rather than retained.
+type SyncPool struct {
+	poolCounters
+	pool  sync.Pool
+	alloc int
+	max   int
+}
+
+// NewSyncPool returns a SyncPool allocating buffers with alloc
+// capacity and dropping buffers grown past max, max <= 0 retains
+// every buffer
+func NewSyncPool(alloc, max int) *SyncPool {
+	return &SyncPool{alloc: alloc, max: max}
+}
+
+// Get returns a pooled buffer or a new one with alloc capacity
+func (p *SyncPool) Get() *bytes.Buffer {
+	b, ok := p.pool.Get().(*bytes.Buffer)
+	p.get(!ok)
+	if ok {
+		return b
+	}
+	return bytes.NewBuffer(make([]byte, 0, p.alloc))
+}
+
+// Put resets b and retains it unless it grew past max capacity
+func (p *SyncPool) Put(b *bytes.Buffer) {
+	discard := p.max > 0 && b.Cap() > p.max
+	p.put(b, discard)
+	if discard {
+		return
+	}
+	b.Reset()
+	p.pool.Put(b)
+}
+
+// SizedPool adapts bpool.SizedBufferPool to a StatsPool. bpool
+// doesn't report misses, they are counted from the buffers SizedPool
+// expects to be idle in the channel.
+type SizedPool struct {
+	poolCounters
+	pool  *bpool.SizedBufferPool
+	size  int64
+	alloc int
+	idle  atomic.Int64
+}
+
+// NewSizedPool returns a SizedPool retaining at most size buffers of
+// alloc capacity
+func NewSizedPool(size, alloc int) *SizedPool {
+	return &SizedPool{
+		pool:  bpool.NewSizedBufferPool(size, alloc),
+		size:  int64(size),
+		alloc: alloc,
+	}
+}
+
+// Get returns a pooled buffer or a new one with alloc capacity
+func (p *SizedPool) Get() *bytes.Buffer {
+	miss := true
+	for {
+		idle := p.idle.Load()
+		if idle <= 0 {
+			break
+		}
+		if p.idle.CompareAndSwap(idle, idle-1) {
+			miss = false
+			break
+		}
+	}
+	p.get(miss)
+	return p.pool.Get()
+}
+
+// Put returns b to the bounded pool, bpool replaces buffers grown
+// past alloc capacity with new ones
+func (p *SizedPool) Put(b *bytes.Buffer) {
+	p.put(b, b.Cap() > p.alloc)
+	for {
+		idle := p.idle.Load()
+		if idle >= p.size || p.idle.CompareAndSwap(idle, idle+1) {
+			break
+		}
+	}
+	p.pool.Put(b)
+}
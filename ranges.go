@@ -0,0 +1,204 @@
+package wrap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// MaxRanges is the most ranges Ranges answers, a Range header asking
+// for more is ignored
+var MaxRanges = 16
+
+// errUnsatisfiable is returned by parseRanges when no range overlaps
+// the body
+var errUnsatisfiable = errors.New("wrap: unsatisfiable range")
+
+// byteRange is a range of the body from start, length bytes long
+type byteRange struct {
+	start, length int
+}
+
+// contentRange returns the Content-Range value of the range in a body
+// of size bytes
+func (br byteRange) contentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// Ranges buffers the wrapped handler and answers GET requests with a
+// Range header from the buffered body. Only a 200 response is
+// ranged, Accept-Ranges is set on it. A single range is answered
+// with a 206, several ranges with a 206 multipart/byteranges body
+// and a range beyond the body with a 416. If-Range, compared to the
+// response's ETag or Last-Modified, falls back to the full response
+// when the validator doesn't match. A malformed Range is ignored, as
+// is one with more than MaxRanges ranges or ranges adding up to more
+// than the body, so overlapping ranges can't amplify the response. A
+// panicking handler's response isn't flushed.
+func Ranges(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buffer := NewRequestBufferWriter(w, r)
+		r, span := startSpan(r, "wrap.Ranges")
+		defer endBufferSpan(span, buffer)
+		handler.ServeHTTP(buffer, r)
+		ranged(buffer, r)
+		buffer.FlushAll()
+	})
+}
+
+// ranged replaces the buffered response with the requested ranges
+func ranged(bf *BufferWriter, r *http.Request) {
+	if bf.committed || bf.hijacked || !bf.HasChanged() || !bf.IsOk() {
+		return
+	}
+	if bf.Code != 0 && bf.Code != http.StatusOK {
+		return
+	}
+	header := bf.header
+	header.Set("Accept-Ranges", "bytes")
+	spec := r.Header.Get("Range")
+	if spec == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return
+	}
+	if !ifRange(header, r.Header.Get("If-Range")) {
+		return
+	}
+	body := bf.Buffer.Bytes()
+	size := len(body)
+	ranges, err := parseRanges(spec, size)
+	switch {
+	case err == errUnsatisfiable:
+		code := http.StatusRequestedRangeNotSatisfiable
+		bf.Code = code
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		bf.setBody([]byte(http.StatusText(code) + "\n"))
+		return
+	case err != nil, len(ranges) > MaxRanges, sumRanges(ranges) > size:
+		return
+	}
+	if len(ranges) == 1 {
+		header.Set("Content-Range", ranges[0].contentRange(size))
+		bf.Code = http.StatusPartialContent
+		bf.setBody(body[ranges[0].start : ranges[0].start+ranges[0].length])
+		return
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	var parts bytes.Buffer
+	mw := multipart.NewWriter(&parts)
+	for _, br := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {br.contentRange(size)},
+			"Content-Type":  {contentType},
+		})
+		if err != nil {
+			return
+		}
+		part.Write(body[br.start : br.start+br.length])
+	}
+	mw.Close()
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	header.Del("Content-Range")
+	bf.Code = http.StatusPartialContent
+	bf.setBody(parts.Bytes())
+}
+
+// sumRanges returns the total length of ranges
+func sumRanges(ranges []byteRange) int {
+	sum := 0
+	for _, br := range ranges {
+		sum += br.length
+	}
+	return sum
+}
+
+// ifRange returns true when the If-Range validator, if any, matches
+// the response's ETag with a strong comparison or its Last-Modified
+// date exactly
+func ifRange(header http.Header, validator string) bool {
+	switch {
+	case validator == "":
+		return true
+	case strings.HasPrefix(validator, `"`), strings.HasPrefix(validator, "W/"):
+		etag := header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && etag == validator
+	}
+	modified := header.Get("Last-Modified")
+	if modified == "" {
+		return false
+	}
+	since, err := http.ParseTime(validator)
+	if err != nil {
+		return false
+	}
+	last, err := http.ParseTime(modified)
+	return err == nil && last.Equal(since)
+}
+
+// parseRanges parses a bytes Range header against a body of size
+// bytes, ranges past the end are dropped and errUnsatisfiable is
+// returned when none is left
+func parseRanges(spec string, size int) ([]byteRange, error) {
+	specs, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok {
+		return nil, errors.New("wrap: invalid range unit")
+	}
+	var ranges []byteRange
+	for _, part := range strings.Split(specs, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errors.New("wrap: invalid range")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var br byteRange
+		if first == "" {
+			n, err := strconv.Atoi(last)
+			if err != nil || n < 0 {
+				return nil, errors.New("wrap: invalid range")
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.Atoi(first)
+			if err != nil || start < 0 {
+				return nil, errors.New("wrap: invalid range")
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.Atoi(last)
+				if err != nil || end < start {
+					return nil, errors.New("wrap: invalid range")
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			br = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, br)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
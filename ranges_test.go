@@ -0,0 +1,108 @@
+package wrap
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_Ranges(t *testing.T) {
+	tagged := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"body"`)
+		a(w, r)
+	})
+	tests := []struct {
+		spec, ifRange string
+		code          int
+		body, cr      string
+	}{
+		{"", "", http.StatusOK, "Body Text", ""},
+		{"bytes=0-3", "", http.StatusPartialContent, "Body", "bytes 0-3/9"},
+		{"bytes=5-", "", http.StatusPartialContent, "Text", "bytes 5-8/9"},
+		{"bytes=-4", "", http.StatusPartialContent, "Text", "bytes 5-8/9"},
+		{"bytes=5-100", `"body"`, http.StatusPartialContent, "Text", "bytes 5-8/9"},
+		{"bytes=5-", `"other"`, http.StatusOK, "Body Text", ""},
+		{"bytes=9-", "", http.StatusRequestedRangeNotSatisfiable, "Requested Range Not Satisfiable\n", "bytes */9"},
+		{"lines=1-2", "", http.StatusOK, "Body Text", ""},
+		{"bytes=0-,0-", "", http.StatusOK, "Body Text", ""},
+		{"bytes=0-4,-5", "", http.StatusOK, "Body Text", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.spec != "" {
+			req.Header.Set("Range", test.spec)
+		}
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		rec := httptest.NewRecorder()
+		Ranges(tagged).ServeHTTP(rec, req)
+		if rec.Code != test.code || rec.Body.String() != test.body || rec.Header().Get("Content-Range") != test.cr {
+			t.Errorf("%q: unexpected response %d %q %q", test.spec, rec.Code, rec.Body.String(), rec.Header().Get("Content-Range"))
+		}
+	}
+}
+
+func Test_RangesMultipart(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=0-3, 5-8")
+	rec := httptest.NewRecorder()
+	Ranges(A).ServeHTTP(rec, req)
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if rec.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	reader := multipart.NewReader(rec.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(body))
+	}
+	if strings.Join(parts, ",") != "bytes 0-3/9 Body,bytes 5-8/9 Text" {
+		t.Fatalf("unexpected parts %q", parts)
+	}
+}
+
+func Test_RangesLimit(t *testing.T) {
+	spec := "bytes=0-" + strings.Repeat(",0-", 199)
+	big := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100000)))
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", spec)
+	rec := httptest.NewRecorder()
+	Ranges(big).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 100000 {
+		t.Fatalf("unexpected response %d of %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	ranges := make([]string, MaxRanges+1)
+	for i := range ranges {
+		ranges[i] = strconv.Itoa(i*2) + "-" + strconv.Itoa(i*2)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes="+strings.Join(ranges, ","))
+	rec = httptest.NewRecorder()
+	Ranges(big).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 100000 {
+		t.Fatalf("unexpected response %d of %d bytes", rec.Code, rec.Body.Len())
+	}
+	req.Header.Set("Range", "bytes="+strings.Join(ranges[:MaxRanges], ","))
+	rec = httptest.NewRecorder()
+	Ranges(big).ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("unexpected response %d", rec.Code)
+	}
+}
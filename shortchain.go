@@ -0,0 +1,118 @@
+package wrap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrAbort is returned by a LinkFunc, or recorded by Abort, to end a
+// short circuit chain without reporting a failure
+var ErrAbort = errors.New("wrap: chain aborted")
+
+// LinkFunc is a chain link that may end a short circuit chain by
+// returning an error
+type LinkFunc func(http.ResponseWriter, *http.Request) error
+
+// ServeHTTP satisfies the http.Handler interface, the error is
+// dropped
+func (fn LinkFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fn(w, r)
+}
+
+// Link adapts an http.HandlerFunc to a LinkFunc, the link may still
+// end the chain by calling Abort or by setting a non 2xx status on a
+// BufferWriter
+func Link(handler http.HandlerFunc) LinkFunc {
+	name := HandlerName(handler)
+	return func(w http.ResponseWriter, r *http.Request) error {
+		nameLink(r, name)
+		handler(w, r)
+		return nil
+	}
+}
+
+// Stop describes the link that ended a short circuit chain
+type Stop struct {
+	// Index is the position of the link in the chain argument list
+	Index int
+
+	// Code is the status code seen on the writer, 0 when the writer
+	// doesn't cache the status code
+	Code int
+
+	// Err is the error returned by the link, ErrAbort after Abort
+	Err error
+}
+
+// StopFunc is called with the Stop when a link ends a short circuit
+// chain
+type StopFunc func(http.ResponseWriter, *http.Request, *Stop)
+
+type shortChainKey struct{}
+
+// shortChainState is the per request state shared by the links of a
+// short circuit chain
+type shortChainState struct {
+	aborted bool
+}
+
+// Abort ends a short circuit chain after the calling link returns.
+// Abort returns false when the request isn't served by ShortChain.
+func Abort(r *http.Request) bool {
+	state, ok := r.Context().Value(shortChainKey{}).(*shortChainState)
+	if ok {
+		state.aborted = true
+	}
+	return ok
+}
+
+// okWriter is satisfied by writers caching the status code, like
+// BufferWriter
+type okWriter interface {
+	IsOk() bool
+}
+
+// ShortChain creates an ordered chain of links like Chain, but the
+// chain stops at the first link that returns an error, calls Abort
+// or sets a non 2xx status as seen by BufferWriter.IsOk. The
+// remaining links are skipped and stop, if not nil, is called with
+// the link that ended the chain. With a nil stop a link error other
+// than ErrAbort is answered with a 500.
+func ShortChain(stop StopFunc, links ...LinkFunc) http.Handler {
+	if len(links) == 0 {
+		return NoOp
+	}
+	names := make([]string, len(links))
+	for i, link := range links {
+		names[i] = HandlerName(link)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &shortChainState{}
+		r = r.WithContext(context.WithValue(r.Context(), shortChainKey{}, state))
+		for i, link := range links {
+			lr, span := startLinkSpan(r, names[i], i)
+			err := link(w, lr)
+			span.End()
+			if err == nil && state.aborted {
+				err = ErrAbort
+			}
+			ok, cached := w.(okWriter)
+			if err == nil && (!cached || ok.IsOk()) {
+				continue
+			}
+			s := &Stop{Index: i, Err: err}
+			if bf, ok := w.(*BufferWriter); ok {
+				s.Code = bf.Code
+			}
+			switch {
+			case stop != nil:
+				stop(w, r, s)
+			case err != nil && err != ErrAbort:
+				http.Error(w, http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError)
+			}
+			return
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package wrap
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func Test_ShortChainStatus(t *testing.T) {
+	var stopped *Stop
+	stop := func(w http.ResponseWriter, r *http.Request, s *Stop) { stopped = s }
+	handler := HttpScopedHandlerWriter(ShortChain(stop, Link(x), Link(unauthorized), Link(a)))
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || rec.Body.String() != "unauthorized\n" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if stopped == nil || stopped.Index != 1 || stopped.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected stop %+v", stopped)
+	}
+}
+
+func Test_ShortChainError(t *testing.T) {
+	failed := errors.New("failed")
+	var stopped *Stop
+	stop := func(w http.ResponseWriter, r *http.Request, s *Stop) { stopped = s }
+	handler := ShortChain(stop,
+		Link(a),
+		func(w http.ResponseWriter, r *http.Request) error { return failed },
+		Link(a))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "Body Text" {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+	if stopped == nil || stopped.Index != 1 || stopped.Err != failed {
+		t.Fatalf("unexpected stop %+v", stopped)
+	}
+}
+
+func Test_ShortChainAbort(t *testing.T) {
+	aborter := func(w http.ResponseWriter, r *http.Request) {
+		if !Abort(r) {
+			t.Fatal("Abort outside a short circuit chain")
+		}
+	}
+	handler := ShortChain(nil, Link(a), Link(aborter), Link(a))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "Body Text" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,271 @@
+package wrap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span attribute keys set by wrap
+const (
+	AttrMethod   = "http.request.method"
+	AttrPath     = "url.path"
+	AttrStatus   = "http.response.status_code"
+	AttrBodySize = "http.response.body.size"
+	AttrLink     = "wrap.link.name"
+	AttrIndex    = "wrap.link.index"
+	AttrPanic    = "wrap.panic"
+)
+
+// Span is a traced unit of work started by a SpanProvider
+type Span interface {
+	// SetAttribute records a key value pair on the span
+	SetAttribute(key string, value interface{})
+
+	// End completes the span
+	End()
+}
+
+// SpanProvider starts the spans wrap reports, a span per request in
+// the buffer writers and wrapping middleware, a span per link in the
+// chains and a span around the handler Recover wraps. It is small enough to be
+// implemented over an OpenTelemetry tracer without wrap importing it.
+type SpanProvider interface {
+	// Start starts a span named name, child of the span carried by
+	// ctx, returning a context carrying the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// spans holds the SpanProvider set by SetSpanProvider
+var spans atomic.Value
+
+type spanHolder struct {
+	provider SpanProvider
+}
+
+func init() {
+	SetSpanProvider(TracerSpans{})
+}
+
+// SetSpanProvider replaces the SpanProvider, TracerSpans by default,
+// nil disables spans, safe for concurrent use
+func SetSpanProvider(provider SpanProvider) {
+	spans.Store(spanHolder{provider: provider})
+}
+
+// Spans returns the current SpanProvider
+func Spans() SpanProvider {
+	return spans.Load().(spanHolder).provider
+}
+
+// noopSpan is the Span used when spans are disabled
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End()                             {}
+
+// spanProviderKey carries the SpanProvider a TraceConfig installed on
+// a traced request
+type spanProviderKey struct{}
+
+// requestSpans returns the SpanProvider installed on r, Spans() when
+// none is
+func requestSpans(r *http.Request) SpanProvider {
+	if provider, ok := r.Context().Value(spanProviderKey{}).(SpanProvider); ok {
+		return provider
+	}
+	return Spans()
+}
+
+// recording returns false for the noopSpan, so callers skip boxing
+// attributes nobody records
+func recording(span Span) bool {
+	_, noop := span.(noopSpan)
+	return !noop
+}
+
+// startSpan starts a span for r with the request attributes, the
+// returned request carries it
+func startSpan(r *http.Request, name string) (*http.Request, Span) {
+	provider := requestSpans(r)
+	if provider == nil {
+		return r, noopSpan{}
+	}
+	ctx, span := provider.Start(r.Context(), name)
+	if !recording(span) {
+		return r, span
+	}
+	span.SetAttribute(AttrMethod, r.Method)
+	span.SetAttribute(AttrPath, r.URL.Path)
+	if ctx != r.Context() {
+		r = r.WithContext(ctx)
+	}
+	return r, span
+}
+
+type linkSpanKey struct{}
+
+// linkSpan is the span of a chain link, named after the link's handler
+// when it ends
+type linkSpan struct {
+	Span
+	name string
+}
+
+// End records the link name and ends the span
+func (s *linkSpan) End() {
+	s.Span.SetAttribute(AttrLink, s.name)
+	s.Span.End()
+}
+
+// startLinkSpan starts the wrap.link span of the chain link at index
+// named name, the returned request carries it so the adapters Link
+// and ContextLink can rename it after the handler they wrap
+func startLinkSpan(r *http.Request, name string, index int) (*http.Request, Span) {
+	r, span := startSpan(r, "wrap.link")
+	if !recording(span) {
+		return r, span
+	}
+	span.SetAttribute(AttrIndex, index)
+	link := &linkSpan{Span: span, name: name}
+	return r.WithContext(context.WithValue(r.Context(), linkSpanKey{}, link)), link
+}
+
+// nameLink names the link span carried by r after an adapted handler
+func nameLink(r *http.Request, name string) {
+	if link, ok := r.Context().Value(linkSpanKey{}).(*linkSpan); ok {
+		link.name = name
+	}
+}
+
+// endBufferSpan records the status code and body size of bf on span
+// and ends it
+func endBufferSpan(span Span, bf *BufferWriter) {
+	if !recording(span) {
+		return
+	}
+	code := bf.Code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	span.SetAttribute(AttrStatus, code)
+	span.SetAttribute(AttrBodySize, bf.Size())
+	span.End()
+}
+
+// TracerSpans is the SpanProvider printing spans as
+// davidwalter0/tracer scoped traces when tracing is enabled by
+// EnableTrace or TraceEnvConfig, it is the console trace of wrap: the
+// buffer writers, the wrapping middleware, chain links and Recover
+// each start a span per request
+type TracerSpans struct{}
+
+// Start starts a console span, a no op unless tracing is enabled
+func (TracerSpans) Start(ctx context.Context, name string) (context.Context, Span) {
+	if !enable.Load() {
+		return ctx, noopSpan{}
+	}
+	return ctx, &tracerSpan{name: name, exit: tracer.Detailed(detail.Load()).Enable(enable.Load()).ScopedTrace(name)}
+}
+
+// tracerSpan prints its attributes when it ends
+type tracerSpan struct {
+	mu    sync.Mutex
+	name  string
+	attrs []string
+	exit  func()
+}
+
+func (s *tracerSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+}
+
+func (s *tracerSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.attrs) > 0 {
+		tracer.Detailed(detail.Load()).Enable(enable.Load()).ScopedTrace(s.name, s.attrs)()
+	}
+	s.exit()
+}
+
+// RecordedSpan is a span recorded by MemorySpans
+type RecordedSpan struct {
+	ID         int
+	Parent     int
+	Name       string
+	Attributes map[string]interface{}
+	Start      time.Time
+	End        time.Time
+}
+
+// MemorySpans is a SpanProvider recording ended spans in memory, for
+// tests
+type MemorySpans struct {
+	mu    sync.Mutex
+	next  int
+	ended []RecordedSpan
+}
+
+type memorySpanKey struct{}
+
+// Start starts a span recorded when it ends, its parent is the span
+// carried by ctx, 0 for none
+func (m *MemorySpans) Start(ctx context.Context, name string) (context.Context, Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	span := &memorySpan{spans: m, recorded: RecordedSpan{
+		ID:         m.next,
+		Name:       name,
+		Attributes: make(map[string]interface{}),
+		Start:      time.Now(),
+	}}
+	if parent, ok := ctx.Value(memorySpanKey{}).(*memorySpan); ok {
+		span.recorded.Parent = parent.recorded.ID
+	}
+	return context.WithValue(ctx, memorySpanKey{}, span), span
+}
+
+// Ended returns the spans ended so far in the order they ended
+func (m *MemorySpans) Ended() []RecordedSpan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RecordedSpan(nil), m.ended...)
+}
+
+// Reset drops the recorded spans
+func (m *MemorySpans) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ended = nil
+}
+
+// memorySpan is a span started by MemorySpans
+type memorySpan struct {
+	spans    *MemorySpans
+	recorded RecordedSpan
+	ended    bool
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+	s.spans.mu.Lock()
+	defer s.spans.mu.Unlock()
+	s.recorded.Attributes[key] = value
+}
+
+func (s *memorySpan) End() {
+	s.spans.mu.Lock()
+	defer s.spans.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.recorded.End = time.Now()
+	s.spans.ended = append(s.spans.ended, s.recorded)
+}
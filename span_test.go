@@ -0,0 +1,79 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Spans(t *testing.T) {
+	memory := &MemorySpans{}
+	SetSpanProvider(memory)
+	defer SetSpanProvider(TracerSpans{})
+
+	handler := HttpScopedHandlerWriter(ChainLinkWrap(RecoverWith(nil), a, failer))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/path", nil))
+	ended := memory.Ended()
+	if len(ended) != 5 {
+		t.Fatalf("unexpected spans %+v", ended)
+	}
+	request := ended[len(ended)-1]
+	if request.Name != "wrap.HttpScopedHandlerWriter" || request.Parent != 0 ||
+		request.Attributes[AttrStatus] != http.StatusInternalServerError ||
+		request.Attributes[AttrBodySize] != 22 || request.Attributes[AttrPath] != "/path" {
+		t.Fatalf("unexpected request span %+v", request)
+	}
+	var panicked bool
+	for _, span := range ended[:4] {
+		switch span.Name {
+		case "wrap.link":
+			if span.Parent != request.ID {
+				t.Errorf("link span not a child of the request span %+v", span)
+			}
+		case "wrap.Recover":
+			if span.Attributes[AttrPanic] == ":Failure" {
+				panicked = true
+			}
+		default:
+			t.Errorf("unexpected span %+v", span)
+		}
+	}
+	if !panicked {
+		t.Errorf("panic not recorded %+v", ended)
+	}
+}
+
+func Test_LinkSpanNames(t *testing.T) {
+	memory := &MemorySpans{}
+	SetSpanProvider(memory)
+	defer SetSpanProvider(TracerSpans{})
+
+	for _, handler := range []http.Handler{
+		ShortChain(nil, Link(x), Link(a)),
+		ChainContext(WithValue(userKey{}, "user"), ContextLink(A)),
+	} {
+		memory.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		ended := memory.Ended()
+		if len(ended) != 2 {
+			t.Fatalf("unexpected spans %+v", ended)
+		}
+		for _, span := range ended {
+			if span.Name != "wrap.link" || span.Parent != 0 {
+				t.Errorf("unexpected link span %+v", span)
+			}
+		}
+		if link := ended[1]; link.Attributes[AttrLink] != "wrap.a" || link.Attributes[AttrIndex] != 1 {
+			t.Errorf("link span not named after the wrapped handler %+v", link)
+		}
+	}
+}
+
+func Benchmark_Chain_Spans_Off(b *testing.B) {
+	handler := Chain(x, y, z, a)
+	req := httptest.NewRequest("GET", "/", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
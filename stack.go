@@ -0,0 +1,57 @@
+package wrap
+
+import "net/http"
+
+// Stack is an immutable ordered list of ChainerFunc middleware, the
+// first middleware is the outermost. Append and Extend return new
+// stacks so a base stack can be shared across routes.
+type Stack struct {
+	chainers []ChainerFunc
+}
+
+// NewStack creates a Stack of the middleware in the argument list
+func NewStack(chainers ...ChainerFunc) Stack {
+	return Stack{}.Append(chainers...)
+}
+
+// Append returns a new Stack with chainers added after the
+// middleware of s
+func (s Stack) Append(chainers ...ChainerFunc) Stack {
+	appended := make([]ChainerFunc, 0, len(s.chainers)+len(chainers))
+	appended = append(appended, s.chainers...)
+	appended = append(appended, chainers...)
+	return Stack{chainers: appended}
+}
+
+// Extend returns a new Stack with the middleware of other added
+// after the middleware of s
+func (s Stack) Extend(other Stack) Stack {
+	return s.Append(other.chainers...)
+}
+
+// Len returns the number of middleware in the stack
+func (s Stack) Len() int {
+	return len(s.chainers)
+}
+
+// Then wraps handler with the middleware of the stack, a nil handler
+// is replaced by NoOp
+// The stack R,S,T => R(S(T(handler)))
+func (s Stack) Then(handler http.Handler) http.Handler {
+	if handler == nil {
+		handler = NoOp
+	}
+	for i := len(s.chainers) - 1; i >= 0; i-- {
+		handler = s.chainers[i](handler)
+	}
+	return handler
+}
+
+// ThenFunc wraps the handler function with the middleware of the
+// stack
+func (s Stack) ThenFunc(handler http.HandlerFunc) http.Handler {
+	if handler == nil {
+		return s.Then(nil)
+	}
+	return s.Then(handler)
+}
@@ -0,0 +1,42 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func tag(name string) ChainerFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func Test_Stack(t *testing.T) {
+	base := NewStack(tag("R"), tag("S"))
+	left := base.Append(tag("T"))
+	right := base.Extend(NewStack(tag("U")))
+	tests := []struct {
+		handler http.Handler
+		body    string
+	}{
+		{base.ThenFunc(a), "RSBody Text"},
+		{left.Then(A), "RSTBody Text"},
+		{right.ThenFunc(a), "RSUBody Text"},
+		{right.Then(nil), "RSU"},
+		{HttpScopedHandlerWriter(NewStack(HttpScopedBPHandlerWriter, Recover).ThenFunc(a)), "Body Text"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		test.handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Body.String() != test.body {
+			t.Errorf("expected %q got %q", test.body, rec.Body.String())
+		}
+	}
+	if base.Len() != 2 {
+		t.Errorf("base stack modified %d", base.Len())
+	}
+}
@@ -0,0 +1,137 @@
+package wrap
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout returns a ChainerFunc running the wrapped handler against
+// its own BufferWriter with a request context bound by dt. The
+// buffered response is flushed only if the handler returns before
+// the deadline, otherwise the partial buffer is discarded and code
+// with body is written instead, so a client never sees half a
+// response. Writes by the handler after the deadline return
+// http.ErrHandlerTimeout. A panic in the handler is propagated to
+// the calling goroutine.
+//
+// code is usually http.StatusServiceUnavailable or
+// http.StatusGatewayTimeout.
+func Timeout(dt time.Duration, code int, body string) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, span := startSpan(r, "wrap.Timeout")
+			defer span.End()
+			ctx, cancel := context.WithTimeout(r.Context(), dt)
+			defer cancel()
+			tw := &timeoutWriter{buffer: NewRequestBufferWriter(w, r)}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if err := recover(); err != nil {
+						panicked <- err
+					}
+				}()
+				handler.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+			select {
+			case err := <-panicked:
+				panic(err)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.buffer.FlushAll()
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if ctx.Err() == context.DeadlineExceeded {
+					span.SetAttribute(AttrStatus, code)
+					w.WriteHeader(code)
+					io.WriteString(w, body)
+				}
+			}
+		})
+	}
+}
+
+// timeoutWriter guards the BufferWriter a Timeout handler writes to,
+// after the deadline the handler's writes are refused. It doesn't
+// expose the BufferWriter methods flushing to the underlying
+// ResponseWriter.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	buffer   *BufferWriter
+	timedOut bool
+}
+
+// Header returns the buffered http.Header
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.buffer.Header()
+}
+
+// WriteHeader caches the status code until the deadline
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		tw.buffer.WriteHeader(code)
+	}
+}
+
+// Write buffers b until the deadline, returning
+// http.ErrHandlerTimeout after it
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.buffer.Write(b)
+}
+
+// Context looks up the value of ctxPtr's type until the deadline
+func (tw *timeoutWriter) Context(ctxPtr interface{}) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return !tw.timedOut && tw.buffer.Context(ctxPtr)
+}
+
+// Reset drops the buffered response until the deadline, so a Recover
+// inside Timeout can replace it
+func (tw *timeoutWriter) Reset() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		tw.buffer.Reset()
+	}
+}
+
+// Committed returns true once the buffered response was committed or
+// the deadline replaced it
+func (tw *timeoutWriter) Committed() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.timedOut || tw.buffer.Committed()
+}
+
+// IsOk returns true if the buffered status code is unset or 2xx,
+// false after the deadline
+func (tw *timeoutWriter) IsOk() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return !tw.timedOut && tw.buffer.IsOk()
+}
+
+// SetContext stores the value ctxPtr points to until the deadline
+func (tw *timeoutWriter) SetContext(ctxPtr interface{}) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		tw.buffer.SetContext(ctxPtr)
+	}
+}
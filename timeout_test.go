@@ -0,0 +1,46 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Timeout(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		<-r.Context().Done()
+	}
+	handler := Timeout(10*time.Millisecond, http.StatusGatewayTimeout, "timeout")(http.HandlerFunc(slow))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusGatewayTimeout || rec.Body.String() != "timeout" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	handler = Timeout(time.Minute, http.StatusGatewayTimeout, "timeout")(Chain(a))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, Response()) {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func Test_TimeoutWriter(t *testing.T) {
+	handler := Timeout(time.Minute, http.StatusGatewayTimeout, "timeout")(RecoverWith(nil)(Chain(a, failer)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != ErrorResponse().Body.String() {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	var stopped *Stop
+	stop := func(w http.ResponseWriter, r *http.Request, s *Stop) { stopped = s }
+	handler = Timeout(time.Minute, http.StatusGatewayTimeout, "timeout")(ShortChain(stop, Link(unauthorized), Link(a)))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if stopped == nil || stopped.Index != 0 || rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected stop %+v %d %q", stopped, rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,122 @@
+package wrap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinkTiming is the time a chain link took to serve a request
+type LinkTiming struct {
+	// Index is the position of the link in the chain argument list
+	Index int
+
+	// Name is the link's handler function name, like wrap.A
+	Name string
+
+	// Start is when the link was called
+	Start time.Time
+
+	// Duration is how long the link took
+	Duration time.Duration
+}
+
+// TimingHook receives the LinkTiming of each link Chain and
+// ChainLinkWrap run for a request carrying the hook
+type TimingHook interface {
+	LinkTimed(r *http.Request, timing LinkTiming)
+}
+
+// TimingHookFunc adapts a function to a TimingHook
+type TimingHookFunc func(r *http.Request, timing LinkTiming)
+
+// LinkTimed satisfies the TimingHook interface
+func (fn TimingHookFunc) LinkTimed(r *http.Request, timing LinkTiming) {
+	fn(r, timing)
+}
+
+type timingKey struct{}
+
+// timingHooks calls each hook installed on a request
+type timingHooks []TimingHook
+
+func (hooks timingHooks) LinkTimed(r *http.Request, timing LinkTiming) {
+	for _, hook := range hooks {
+		hook.LinkTimed(r, timing)
+	}
+}
+
+// timingHook returns the hooks installed on r, nil without any
+func timingHook(r *http.Request) TimingHook {
+	if hooks, ok := r.Context().Value(timingKey{}).(timingHooks); ok {
+		return hooks
+	}
+	return nil
+}
+
+// Timed returns a ChainerFunc installing hook on the request, the
+// links of the chains it wraps report their LinkTiming to hook, and to
+// any hook installed by an outer Timed
+func Timed(hook TimingHook) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hooks, _ := r.Context().Value(timingKey{}).(timingHooks)
+			hooks = append(hooks[:len(hooks):len(hooks)], hook)
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timingKey{}, hooks)))
+		})
+	}
+}
+
+// ServerTiming buffers the wrapped handler and reports the LinkTiming
+// of its chain links in a Server-Timing header of the buffered
+// response, one link<index> metric per link with the handler name as
+// description and the duration in milliseconds, a panicking
+// handler's response isn't flushed
+func ServerTiming(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var mu sync.Mutex
+		var metrics []string
+		collect := TimingHookFunc(func(r *http.Request, timing LinkTiming) {
+			mu.Lock()
+			defer mu.Unlock()
+			metrics = append(metrics, fmt.Sprintf("link%d;desc=%q;dur=%.3f", timing.Index, timing.Name,
+				float64(timing.Duration)/float64(time.Millisecond)))
+		})
+		buffer := NewRequestBufferWriter(w, r)
+		buffer.Transform(func(code int, header http.Header, body []byte) (int, http.Header, []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(metrics) > 0 {
+				header.Add("Server-Timing", strings.Join(metrics, ", "))
+			}
+			return code, header, body
+		})
+		r, span := startSpan(r, "wrap.ServerTiming")
+		defer endBufferSpan(span, buffer)
+		Timed(collect)(handler).ServeHTTP(buffer, r)
+		buffer.FlushAll()
+	})
+}
+
+// HandlerName returns the name of handler's function, package path
+// trimmed, like wrap.A
+func HandlerName(handler interface{}) string {
+	value := reflect.ValueOf(handler)
+	if value.Kind() != reflect.Func || value.IsNil() {
+		return fmt.Sprintf("%T", handler)
+	}
+	fn := runtime.FuncForPC(value.Pointer())
+	if fn == nil {
+		return fmt.Sprintf("%T", handler)
+	}
+	name := fn.Name()
+	if slash := strings.LastIndex(name, "/"); slash >= 0 {
+		name = name[slash+1:]
+	}
+	return name
+}
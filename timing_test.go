@@ -0,0 +1,42 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func slow(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(5 * time.Millisecond)
+}
+
+func Test_Timed(t *testing.T) {
+	var timings []LinkTiming
+	hook := TimingHookFunc(func(r *http.Request, timing LinkTiming) {
+		timings = append(timings, timing)
+	})
+	handler := Timed(hook)(ChainLinkWrap(Recover, x, slow, a))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if len(timings) != 3 {
+		t.Fatalf("unexpected timings %+v", timings)
+	}
+	for i, name := range []string{"wrap.x", "wrap.slow", "wrap.a"} {
+		if timings[i].Index != i || timings[i].Name != name {
+			t.Errorf("unexpected timing %+v", timings[i])
+		}
+	}
+	if timings[1].Duration < 5*time.Millisecond {
+		t.Errorf("slow link not timed %v", timings[1].Duration)
+	}
+}
+
+func Test_ServerTiming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ServerTiming(Chain(x, a)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	pattern := `^link0;desc="wrap.x";dur=[0-9.]+, link1;desc="wrap.a";dur=[0-9.]+$`
+	if !compare(rec, Response()) || !regexp.MustCompile(pattern).MatchString(rec.Header().Get("Server-Timing")) {
+		t.Fatalf("unexpected Server-Timing %q", rec.Header().Get("Server-Timing"))
+	}
+}
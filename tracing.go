@@ -0,0 +1,303 @@
+package wrap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceLevel is the detail of the request trace a TraceConfig writes
+type TraceLevel int32
+
+// TraceLevel values, TraceSpans writes a line per span, TraceDetail
+// adds the span attributes
+const (
+	TraceOff TraceLevel = iota
+	TraceSpans
+	TraceDetail
+)
+
+var traceLevels = []string{"off", "spans", "detail"}
+
+func (level TraceLevel) String() string {
+	if level < 0 || int(level) >= len(traceLevels) {
+		return "TraceLevel(" + strconv.Itoa(int(level)) + ")"
+	}
+	return traceLevels[level]
+}
+
+// MarshalJSON writes the level by name
+func (level TraceLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(level.String())
+}
+
+// ParseTraceLevel parses off, spans or detail, on is spans
+func ParseTraceLevel(s string) (TraceLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "off", "false", "0", "disable":
+		return TraceOff, nil
+	case "spans", "on", "true", "1", "enable":
+		return TraceSpans, nil
+	case "detail", "detailed", "2":
+		return TraceDetail, nil
+	}
+	return TraceOff, fmt.Errorf("wrap: unknown trace level %q", s)
+}
+
+// TraceConfig configures the request trace of the handlers it wraps
+// with Traced: the default level, the level of path prefixes
+// overriding it, the sample rate and the output writer. Every setter
+// is safe to call while serving, the handlers see the change on their
+// next request.
+type TraceConfig struct {
+	mu       sync.Mutex
+	snapshot atomic.Pointer[traceSnapshot]
+	next     int64
+}
+
+// traceSnapshot is an immutable TraceConfig state, replaced as a whole
+// by the setters
+type traceSnapshot struct {
+	Level  TraceLevel            `json:"level"`
+	Rate   float64               `json:"rate"`
+	Routes map[string]TraceLevel `json:"routes"`
+	out    *lockedWriter
+}
+
+// NewTraceConfig returns a TraceConfig writing to out, os.Stderr when
+// nil, tracing nothing until a level is set, with a sample rate of 1
+func NewTraceConfig(out io.Writer) *TraceConfig {
+	if out == nil {
+		out = os.Stderr
+	}
+	c := &TraceConfig{}
+	c.snapshot.Store(&traceSnapshot{Rate: 1, Routes: map[string]TraceLevel{}, out: &lockedWriter{w: out}})
+	return c
+}
+
+// update replaces the snapshot with a copy changed by fn
+func (c *TraceConfig) update(fn func(s *traceSnapshot)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.snapshot.Load()
+	s := &traceSnapshot{Level: old.Level, Rate: old.Rate, Routes: make(map[string]TraceLevel, len(old.Routes)), out: old.out}
+	for route, level := range old.Routes {
+		s.Routes[route] = level
+	}
+	fn(s)
+	c.snapshot.Store(s)
+}
+
+// SetLevel sets the level of the paths without a route level
+func (c *TraceConfig) SetLevel(level TraceLevel) {
+	c.update(func(s *traceSnapshot) { s.Level = level })
+}
+
+// SetRoute sets the level of the paths starting with prefix, the
+// longest matching prefix wins over the default level
+func (c *TraceConfig) SetRoute(prefix string, level TraceLevel) {
+	c.update(func(s *traceSnapshot) { s.Routes[prefix] = level })
+}
+
+// ClearRoute drops the level of prefix
+func (c *TraceConfig) ClearRoute(prefix string) {
+	c.update(func(s *traceSnapshot) { delete(s.Routes, prefix) })
+}
+
+// SetSampleRate sets the fraction, from 0 to 1, of the requests of
+// traced paths that are traced
+func (c *TraceConfig) SetSampleRate(rate float64) {
+	if rate < 0 {
+		rate = 0
+	} else if rate > 1 {
+		rate = 1
+	}
+	c.update(func(s *traceSnapshot) { s.Rate = rate })
+}
+
+// SetOutput sets the writer the trace is written to, nil for
+// os.Stderr
+func (c *TraceConfig) SetOutput(out io.Writer) {
+	if out == nil {
+		out = os.Stderr
+	}
+	c.update(func(s *traceSnapshot) { s.out = &lockedWriter{w: out} })
+}
+
+// Level returns the level of path, TraceOff when it isn't traced
+func (c *TraceConfig) Level(path string) TraceLevel {
+	s := c.snapshot.Load()
+	level, match := s.Level, -1
+	for prefix, l := range s.Routes {
+		if len(prefix) > match && strings.HasPrefix(path, prefix) {
+			level, match = l, len(prefix)
+		}
+	}
+	return level
+}
+
+// sampled returns the level r is traced at after sampling
+func (c *TraceConfig) sampled(r *http.Request) TraceLevel {
+	level := c.Level(r.URL.Path)
+	if level == TraceOff {
+		return TraceOff
+	}
+	if rate := c.snapshot.Load().Rate; rate < 1 && rand.Float64() >= rate {
+		return TraceOff
+	}
+	return level
+}
+
+// Traced returns a ChainerFunc tracing the requests of the wrapped
+// handler the TraceConfig selects, the spans wrap starts for the
+// request, the buffer writers, chain links and Recover, are written to
+// the output a line each, and passed on to the SpanProvider set by
+// SetSpanProvider
+func (c *TraceConfig) Traced() ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			level := c.sampled(r)
+			if level == TraceOff {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			provider := &writerSpans{
+				id:    atomic.AddInt64(&c.next, 1),
+				level: level,
+				out:   c.snapshot.Load().out,
+				next:  requestSpans(r),
+			}
+			r, span := startSpan(r.WithContext(context.WithValue(r.Context(), spanProviderKey{}, SpanProvider(provider))), "wrap.Traced")
+			defer span.End()
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AdminHandler returns a handler reading and changing the TraceConfig.
+// GET answers the config as JSON. POST sets it from the form values
+// level, route and rate, a level with a route sets the level of that
+// path prefix, without sets the default level. DELETE clears the
+// level of route. POST and DELETE answer the resulting config.
+//
+//	curl -d route=/api -d level=detail http://host/admin/trace
+func (c *TraceConfig) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			if err := c.configure(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			route := r.FormValue("route")
+			if route == "" {
+				http.Error(w, "wrap: route required", http.StatusBadRequest)
+				return
+			}
+			c.ClearRoute(route)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.snapshot.Load())
+	})
+}
+
+// configure applies the form values of an AdminHandler POST, checking
+// all of them before changing anything
+func (c *TraceConfig) configure(r *http.Request) error {
+	var level TraceLevel
+	var rate float64
+	var err error
+	levelValue, rateValue := r.FormValue("level"), r.FormValue("rate")
+	if levelValue != "" {
+		if level, err = ParseTraceLevel(levelValue); err != nil {
+			return err
+		}
+	}
+	if rateValue != "" {
+		if rate, err = strconv.ParseFloat(rateValue, 64); err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("wrap: invalid sample rate %q", rateValue)
+		}
+	}
+	if levelValue != "" {
+		if route := r.FormValue("route"); route != "" {
+			c.SetRoute(route, level)
+		} else {
+			c.SetLevel(level)
+		}
+	}
+	if rateValue != "" {
+		c.SetSampleRate(rate)
+	}
+	return nil
+}
+
+// writerSpans is the SpanProvider Traced installs on a traced request
+type writerSpans struct {
+	id    int64
+	level TraceLevel
+	out   *lockedWriter
+	next  SpanProvider
+}
+
+func (p *writerSpans) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &writerSpan{spans: p, name: name, start: time.Now()}
+	if p.next != nil {
+		ctx, span.next = p.next.Start(ctx, name)
+	}
+	return ctx, span
+}
+
+// writerSpan writes a line when it ends, with its attributes at
+// TraceDetail
+type writerSpan struct {
+	spans *writerSpans
+	name  string
+	start time.Time
+	next  Span
+
+	mu    sync.Mutex
+	attrs []string
+}
+
+func (s *writerSpan) SetAttribute(key string, value interface{}) {
+	if s.next != nil {
+		s.next.SetAttribute(key, value)
+	}
+	if s.spans.level < TraceDetail {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+}
+
+func (s *writerSpan) End() {
+	if s.next != nil {
+		s.next.End()
+	}
+	s.mu.Lock()
+	attrs := append([]string(nil), s.attrs...)
+	s.mu.Unlock()
+	sort.Strings(attrs)
+	line := fmt.Sprintf("wrap trace=%d span=%s duration=%s", s.spans.id, s.name, time.Since(s.start))
+	if len(attrs) > 0 {
+		line += " " + strings.Join(attrs, " ")
+	}
+	s.spans.out.write([]byte(line + "\n"))
+}
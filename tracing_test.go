@@ -0,0 +1,102 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func Test_TraceConfig(t *testing.T) {
+	var out syncBuffer
+	config := NewTraceConfig(&out)
+	handler := config.Traced()(HttpScopedHandlerWriter(Chain(a, x)))
+	serve := func(path string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if !compare(rec, Response()) {
+			t.Fatalf("unexpected response %q", rec.Body.String())
+		}
+	}
+
+	serve("/api/a")
+	if out.Len() != 0 {
+		t.Fatalf("traced with level off %q", out.String())
+	}
+
+	config.SetRoute("/api", TraceSpans)
+	config.SetRoute("/api/quiet", TraceOff)
+	serve("/api/quiet/a")
+	serve("/other")
+	if out.Len() != 0 {
+		t.Fatalf("traced other route %q", out.String())
+	}
+	serve("/api/a")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[3], "wrap trace=1 span=wrap.Traced ") || strings.Contains(out.String(), "url.path") {
+		t.Fatalf("unexpected trace %q", out.String())
+	}
+
+	out.Reset()
+	config.SetLevel(TraceDetail)
+	serve("/other")
+	if !strings.Contains(out.String(), "span=wrap.HttpScopedHandlerWriter ") || !strings.Contains(out.String(), "http.response.body.size=9") {
+		t.Fatalf("unexpected detailed trace %q", out.String())
+	}
+
+	out.Reset()
+	config.SetSampleRate(0)
+	serve("/other")
+	if out.Len() != 0 {
+		t.Fatalf("traced with sample rate 0 %q", out.String())
+	}
+}
+
+func Test_TraceAdminHandler(t *testing.T) {
+	config := NewTraceConfig(nil)
+	admin := config.AdminHandler()
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/trace", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(url.Values{"route": {"/api"}, "level": {"detail"}, "rate": {"0.5"}})
+	var state struct {
+		Level  string
+		Rate   float64
+		Routes map[string]string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil || state.Level != "off" || state.Rate != 0.5 || state.Routes["/api"] != "detail" {
+		t.Fatalf("unexpected state %q %v", rec.Body.String(), err)
+	}
+	if config.Level("/api/a") != TraceDetail || config.Level("/") != TraceOff {
+		t.Fatalf("unexpected levels")
+	}
+
+	if rec := post(url.Values{"level": {"loud"}, "rate": {"0"}}); rec.Code != 400 {
+		t.Fatalf("unexpected code %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/trace?route=/api", nil))
+	if rec.Code != 200 || config.Level("/api/a") != TraceOff || !strings.Contains(rec.Body.String(), `"rate":0.5`) {
+		t.Fatalf("unexpected delete %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package wrap
+
+import "net/http"
+
+// Transformer rewrites a buffered response between the handler
+// returning and the flush, it receives the status code, the header
+// and the body and returns their replacements, which may be the ones
+// it received
+type Transformer func(code int, header http.Header, body []byte) (int, http.Header, []byte)
+
+// Transforms composes transformers into one, each receiving the
+// response returned by the previous one
+// The transformers T,U,V => V(U(T(response)))
+func Transforms(transformers ...Transformer) Transformer {
+	return func(code int, header http.Header, body []byte) (int, http.Header, []byte) {
+		for _, transformer := range transformers {
+			code, header, body = transformer(code, header, body)
+		}
+		return code, header, body
+	}
+}
+
+// Transforming returns a ChainerFunc buffering the wrapped handler
+// and running transformers over the buffered response before it is
+// flushed, a panicking handler's response isn't flushed
+func Transforming(transformers ...Transformer) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buffer := NewRequestBufferWriter(w, r)
+			buffer.Transform(transformers...)
+			r, span := startSpan(r, "wrap.Transforming")
+			defer endBufferSpan(span, buffer)
+			handler.ServeHTTP(buffer, r)
+			buffer.FlushAll()
+		})
+	}
+}
+
+// Transform appends transformers to the pipeline FlushAll runs over
+// the buffered response, a response committed by Flush isn't
+// transformed
+func (bf *BufferWriter) Transform(transformers ...Transformer) {
+	bf.transformers = append(bf.transformers, transformers...)
+}
+
+// transform runs the pipeline once, an unset status code is passed
+// as 200
+func (bf *BufferWriter) transform() {
+	if len(bf.transformers) == 0 {
+		return
+	}
+	code := bf.Code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	code, header, body := Transforms(bf.transformers...)(code, bf.header, bf.Buffer.Bytes())
+	bf.transformers = nil
+	bf.Code = code
+	if header == nil {
+		header = make(http.Header)
+	}
+	bf.header = header
+	bf.setBody(body)
+}
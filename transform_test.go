@@ -0,0 +1,27 @@
+package wrap
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Transforming(t *testing.T) {
+	replace := func(old, new string) Transformer {
+		return func(code int, header http.Header, body []byte) (int, http.Header, []byte) {
+			return code, header, bytes.ReplaceAll(body, []byte(old), []byte(new))
+		}
+	}
+	created := func(code int, header http.Header, body []byte) (int, http.Header, []byte) {
+		header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "X-Transformed": {"true"}}
+		return http.StatusCreated, header, body
+	}
+	handler := Transforming(Transforms(replace("Body", "Transformed"), replace("Text", "Body")), created)(A)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "Transformed Body" ||
+		rec.Header().Get("X-Transformed") != "true" || rec.Header().Get("Content-Length") != "16" {
+		t.Fatalf("unexpected response %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
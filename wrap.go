@@ -2,15 +2,26 @@ package wrap
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func HttpScopedBufferHandler(handler http.Handler) http.Handler {
 	switch strings.ToLower(os.Getenv("WRAP_BUFFER_HANDLER")) {
 	case "pool", "pooledhandler", "bphandler":
 		return HttpScopedBPHandlerWriter(handler)
+	case "stream", "streaming", "threshold":
+		threshold, err := strconv.Atoi(os.Getenv("WRAP_BUFFER_THRESHOLD"))
+		if err != nil || threshold <= 0 {
+			threshold = BPAlloc
+		}
+		return HttpScopedStreamHandlerWriter(threshold)(handler)
 	case "", "default", "bytes.buffer", "buffer":
 		fallthrough
 	default:
@@ -19,58 +30,215 @@ func HttpScopedBufferHandler(handler http.Handler) http.Handler {
 }
 
 // use a buffer buffer pools buffer then write/flush the buffer to the ResponseWriter.
+// The buffer is returned to the pool after every request, when the
+// handler panics it is returned without flushing the partial response.
 func HttpScopedBPHandlerWriter(handler http.Handler) http.Handler {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		buffer := NewBufferPoolWriter(w)
-		var text string
-		if enable {
-			text = fmt.Sprintf("%v %p", buffer, buffer)
-		}
-		defer buffer.BPFlushAll()
-		defer tracer.Detailed(detail).Enable(enable).ScopedTrace(text)()
-		handler.ServeHTTP(buffer, r)
-	})
+	return HttpScopedPoolHandlerWriter(nil)(handler)
+}
+
+// HttpScopedPoolHandlerWriter returns a ChainerFunc like
+// HttpScopedBPHandlerWriter taking buffers from pool, so routes may
+// use different pools. A nil pool uses BufferPool().
+func HttpScopedPoolHandlerWriter(pool Pool) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := pool
+			if p == nil {
+				p = BufferPool()
+			}
+			buffer := NewPoolWriter(w, p)
+			buffer.Head = headWriter(w, r)
+			r, span := startSpan(r, "wrap.HttpScopedPoolHandlerWriter")
+			defer endBufferSpan(span, buffer)
+			completed := false
+			defer func() {
+				if completed {
+					buffer.BPFlushAll()
+				} else {
+					buffer.bpRelease()
+				}
+			}()
+			handler.ServeHTTP(buffer, r)
+			completed = true
+		})
+	}
 }
 
 // use a bytes.Buffer then write/flush the buffer to the ResponseWriter
 func HttpScopedHandlerWriter(handler http.Handler) http.Handler {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		buffer := NewBufferWriter(w)
-		var text string
-		if enable {
-			text = fmt.Sprintf("%v %p", buffer, buffer)
-		}
+		buffer := NewRequestBufferWriter(w, r)
+		r, span := startSpan(r, "wrap.HttpScopedHandlerWriter")
+		defer endBufferSpan(span, buffer)
 		defer buffer.FlushAll()
-		defer tracer.Detailed(detail).Enable(enable).ScopedTrace(text)()
 		handler.ServeHTTP(buffer, r)
 	})
 }
 
-var NoOp = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
-})
-
-// Recover recovers from any panicking goroutine
-func Recover(next http.Handler) http.Handler {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
-
+// HttpScopedStrictHandlerWriter buffers like HttpScopedHandlerWriter
+// in Strict mode, a Content-Length set by the handler that doesn't
+// match the body fails the response with a 500. When the handler
+// panics nothing is flushed.
+func HttpScopedStrictHandlerWriter(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+		buffer := NewRequestBufferWriter(w, r)
+		buffer.Strict = true
+		r, span := startSpan(r, "wrap.HttpScopedStrictHandlerWriter")
+		defer endBufferSpan(span, buffer)
+		completed := false
 		defer func() {
-			defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
-			err := recover()
-			if err != nil {
-				fmt.Fprintf(w, "%v", err)
+			if completed {
+				buffer.FlushAll()
 			}
 		}()
-		next.ServeHTTP(w, r)
+		handler.ServeHTTP(buffer, r)
+		completed = true
 	})
 }
 
+// HttpScopedStreamHandlerWriter returns a ChainerFunc buffering up
+// to threshold bytes of the body in a bytes.Buffer, so the status
+// code and headers may still be replaced, then committing and
+// streaming the rest to the ResponseWriter. When the handler panics
+// what is still buffered isn't flushed.
+func HttpScopedStreamHandlerWriter(threshold int) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buffer := NewRequestBufferWriter(w, r)
+			buffer.Threshold = threshold
+			r, span := startSpan(r, "wrap.HttpScopedStreamHandlerWriter")
+			defer endBufferSpan(span, buffer)
+			completed := false
+			defer func() {
+				if completed {
+					buffer.FlushAll()
+				}
+			}()
+			handler.ServeHTTP(buffer, r)
+			completed = true
+		})
+	}
+}
+
+// HttpScopedLimitHandlerWriter returns a ChainerFunc buffering the
+// response like HttpScopedHandlerWriter with a body Limit of limit
+// bytes. When the handler writes past it, onOverflow, if not nil, is
+// called with the *LimitError and, unless the response was committed,
+// the partial buffer is replaced by an error response with code,
+// usually http.StatusInternalServerError or
+// http.StatusInsufficientStorage. When the handler panics nothing is
+// flushed.
+func HttpScopedLimitHandlerWriter(limit, code int, onOverflow func(*http.Request, *LimitError)) ChainerFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buffer := NewRequestBufferWriter(w, r)
+			buffer.Limit = limit
+			r, span := startSpan(r, "wrap.HttpScopedLimitHandlerWriter")
+			defer endBufferSpan(span, buffer)
+			completed := false
+			defer func() {
+				if !completed {
+					return
+				}
+				if overflow := buffer.Overflow(); overflow != nil {
+					if onOverflow != nil {
+						onOverflow(r, overflow)
+					}
+					if !buffer.Committed() {
+						buffer.Reset()
+						buffer.Limit = 0
+						http.Error(buffer, http.StatusText(code), code)
+					}
+				}
+				buffer.FlushAll()
+			}()
+			handler.ServeHTTP(buffer, r)
+			completed = true
+		})
+	}
+}
+
+// committer is satisfied by writers that may have sent the response
+// already, like BufferWriter
+type committer interface {
+	Committed() bool
+}
+
+// resetter is satisfied by writers that can drop what was buffered,
+// like BufferWriter
+type resetter interface {
+	Reset()
+}
+
+var NoOp = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+// PanicHandlerFunc receives the value recovered from a panicking
+// handler, the stack of the panicking goroutine and the request
+type PanicHandlerFunc func(r *http.Request, err interface{}, stack []byte)
+
+// LogPanic is the default PanicHandlerFunc, it logs the panic value
+// and the stack with the standard logger
+func LogPanic(r *http.Request, err interface{}, stack []byte) {
+	log.Printf("wrap: panic serving %s %s: %v\n%s", r.Method, r.URL, err, stack)
+}
+
+// panics counts the panics recovered by Recover and RecoverWith
+var panics int64
+
+// Panics returns the number of panics Recover and RecoverWith
+// recovered, http.ErrAbortHandler included
+func Panics() int64 {
+	return atomic.LoadInt64(&panics)
+}
+
+// RecoverWith returns a ChainerFunc recovering from a panic in the
+// wrapped handler. onPanic, if not nil, is called with the panic
+// value, then a 500 is written without exposing the panic value to
+// the client. When the writer can Reset, like a Buffer, the
+// partially buffered response is reset first so it isn't sent
+// alongside the error. When the writer already committed the response
+// nothing is written. A panic with http.ErrAbortHandler is passed on
+// to net/http. The panic value is recorded on the wrap.Recover span.
+func RecoverWith(onPanic PanicHandlerFunc) ChainerFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, span := startSpan(r, "wrap.Recover")
+			defer span.End()
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				atomic.AddInt64(&panics, 1)
+				span.SetAttribute(AttrPanic, fmt.Sprint(err))
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				if onPanic != nil {
+					onPanic(r, err, debug.Stack())
+				}
+				if c, ok := w.(committer); ok && c.Committed() {
+					return
+				}
+				if buffer, ok := w.(resetter); ok {
+					buffer.Reset()
+				}
+				http.Error(w, http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError)
+				span.SetAttribute(AttrStatus, http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Recover recovers from any panicking goroutine, logging the panic
+// with LogPanic and writing a 500
+func Recover(next http.Handler) http.Handler {
+	return RecoverWith(LogPanic)(next)
+}
+
 func RecoverFunc(next http.HandlerFunc) http.HandlerFunc {
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
 	return Recover(next).(http.HandlerFunc)
 }
 
@@ -78,41 +246,49 @@ func RecoverFunc(next http.HandlerFunc) http.HandlerFunc {
 type ChainerFunc func(http.Handler) http.Handler
 
 // Chain creates an ordered chain of handlers from an argument list
-// The handlers call chain A->B->C => R(A)->R(B)->R(C)
+// The handlers call chain A->B->C => R(A->B->C) when wrapped by R
 func Chain(handlers ...http.HandlerFunc) http.Handler {
-	defer tracer.Enable(enable).ScopedTrace()()
-	if len(handlers) > 1 {
-		next := Chain(handlers[1:]...)
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer tracer.Enable(enable).ScopedTrace()()
-			handlers[0].ServeHTTP(w, r)
-			next.ServeHTTP(w, r)
-		})
-	} else if len(handlers) == 1 {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer tracer.Enable(enable).ScopedTrace()()
-			handlers[0].ServeHTTP(w, r)
-		})
-	}
-	return NoOp
+	return ChainLinkWraps(nil, handlers...)
 }
 
 // ChainLinkWrap wraps each handler in the argument list of handlers
-// The handlers call chain A->B->C => R(A->B->C)
+// The handlers call chain A->B->C => R(A)->R(B)->R(C)
 func ChainLinkWrap(wrapper ChainerFunc, handlers ...http.HandlerFunc) http.Handler {
-	defer tracer.Enable(enable).ScopedTrace()()
-	if len(handlers) > 1 {
-		next := Chain(handlers[1:]...)
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer tracer.Enable(enable).ScopedTrace()()
-			wrapper(handlers[0]).ServeHTTP(w, r)
-			wrapper(next).ServeHTTP(w, r)
-		})
-	} else if len(handlers) == 1 {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer tracer.Enable(enable).ScopedTrace()()
-			wrapper(handlers[0]).ServeHTTP(w, r)
-		})
+	return ChainLinkWraps([]ChainerFunc{wrapper}, handlers...)
+}
+
+// ChainLinkWraps wraps each handler in the argument list of handlers
+// with every wrapper, the first wrapper is the outermost. Each link is
+// named after its handler function and timed when the request carries
+// a TimingHook.
+// The handlers call chain A->B->C => R(S(A))->R(S(B))->R(S(C))
+func ChainLinkWraps(wrappers []ChainerFunc, handlers ...http.HandlerFunc) http.Handler {
+	if len(handlers) == 0 {
+		return NoOp
+	}
+	links := make([]http.Handler, len(handlers))
+	names := make([]string, len(handlers))
+	for i, handler := range handlers {
+		var link http.Handler = handler
+		for j := len(wrappers) - 1; j >= 0; j-- {
+			link = wrappers[j](link)
+		}
+		links[i] = link
+		names[i] = HandlerName(handler)
 	}
-	return NoOp
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook := timingHook(r)
+		for i, link := range links {
+			lr, span := startLinkSpan(r, names[i], i)
+			var start time.Time
+			if hook != nil {
+				start = time.Now()
+			}
+			link.ServeHTTP(w, lr)
+			span.End()
+			if hook != nil {
+				hook.LinkTimed(r, LinkTiming{Index: i, Name: names[i], Start: start, Duration: time.Since(start)})
+			}
+		}
+	})
 }
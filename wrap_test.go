@@ -36,17 +36,11 @@ func Response() *httptest.ResponseRecorder {
 	return &response
 }
 
-func failure() *bytes.Buffer {
-	var b bytes.Buffer
-	b.Write([]byte("Body Text:Failure"))
-	return &b
-}
-
-func FailureResponse() *httptest.ResponseRecorder {
+func ErrorResponse() *httptest.ResponseRecorder {
 	var response httptest.ResponseRecorder = httptest.ResponseRecorder{
-		Code:      200,
+		Code:      http.StatusInternalServerError,
 		HeaderMap: header(),
-		Body:      failure(),
+		Body:      bytes.NewBufferString(http.StatusText(http.StatusInternalServerError) + "\n"),
 		Flushed:   false,
 	}
 	return &response
@@ -79,38 +73,32 @@ func compare(lhs, rhs *httptest.ResponseRecorder) bool {
 }
 
 func x(w http.ResponseWriter, r *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
 }
 
 var X = http.HandlerFunc(x)
 
 func y(w http.ResponseWriter, r *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
 }
 
 var Y = http.HandlerFunc(y)
 
 func z(w http.ResponseWriter, r *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
 }
 
 var Z = http.HandlerFunc(z)
 
 func a(w http.ResponseWriter, r *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
 	w.Write(body().Bytes())
 }
 
 var A = http.HandlerFunc(a)
 
 func b(w http.ResponseWriter, r *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
 }
 
 var B = http.HandlerFunc(b)
 
 func failer(w http.ResponseWriter, r *http.Request) {
-	defer tracer.Enable(enable).ScopedTrace()()
 	panic(":Failure")
 }
 
@@ -123,7 +111,7 @@ func Test_BufferWriteChain(t *testing.T) {
 	}
 	rec := httptest.NewRecorder()
 	handler.ServeHTTP(rec, req)
-	if !compare(rec, FailureResponse()) {
+	if !compare(rec, ErrorResponse()) {
 		t.Fail()
 	}
 }
@@ -247,9 +235,8 @@ func UnBufferedFillHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func Benchmark_Buffer_BP_Multi_Chain_Create_A(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	for i := 0; i < iterations; i++ {
 		handler := HttpScopedBPHandlerWriter(Chain(x, y, z, UnBufferedFillHandler))
@@ -264,9 +251,8 @@ func Benchmark_Buffer_BP_Multi_Chain_Create_A(b *testing.B) {
 }
 
 func Benchmark_Buffer_Multi_Chain_Create_B(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	for i := 0; i < iterations; i++ {
 		handler := HttpScopedHandlerWriter(Chain(x, y, z, UnBufferedFillHandler))
@@ -281,9 +267,8 @@ func Benchmark_Buffer_Multi_Chain_Create_B(b *testing.B) {
 }
 
 func Benchmark_UnBuffered_Multi_Chain_Create_C(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	handler := Chain(x, y, z, UnBufferedFillHandler)
 	for i := 0; i < iterations; i++ {
@@ -298,9 +283,8 @@ func Benchmark_UnBuffered_Multi_Chain_Create_C(b *testing.B) {
 }
 
 func Benchmark_Buffer_BP_Make_One_Chain_D(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	handler := HttpScopedBPHandlerWriter(Chain(x, y, z, BufferFillHandler))
 	for i := 0; i < iterations; i++ {
@@ -315,9 +299,8 @@ func Benchmark_Buffer_BP_Make_One_Chain_D(b *testing.B) {
 }
 
 func Benchmark_Buffer_Make_One_Chain_E(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	handler := HttpScopedHandlerWriter(Chain(x, y, z, BufferFillHandler))
 	for i := 0; i < iterations; i++ {
@@ -332,9 +315,8 @@ func Benchmark_Buffer_Make_One_Chain_E(b *testing.B) {
 }
 
 func Benchmark_UnBuffered_Make_One_Chain_F(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	handler := Chain(x, y, z, UnBufferedFillHandler)
 	for i := 0; i < iterations; i++ {
@@ -349,9 +331,8 @@ func Benchmark_UnBuffered_Make_One_Chain_F(b *testing.B) {
 }
 
 func Benchmark_Buffer_BP_G(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	for i := 0; i < iterations; i++ {
 		req, err := http.NewRequest("GET", "/", nil)
@@ -368,9 +349,8 @@ func Benchmark_Buffer_BP_G(b *testing.B) {
 }
 
 func Benchmark_Buffer_H(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 
 	for i := 0; i < iterations; i++ {
@@ -388,9 +368,8 @@ func Benchmark_Buffer_H(b *testing.B) {
 }
 
 func Benchmark_UnBuffered_I(b *testing.B) {
-	enable = false
-	detail = false
-	defer tracer.Detailed(detail).Enable(enable).ScopedTrace()()
+	enable.Store(false)
+	detail.Store(false)
 	iterations := 100
 	for i := 0; i < iterations; i++ {
 		req, err := http.NewRequest("GET", "/", nil)
@@ -405,3 +384,117 @@ func Benchmark_UnBuffered_I(b *testing.B) {
 		UnBufferedFillHandler(rec, req)
 	}
 }
+
+type session struct {
+	user string
+}
+
+func Test_BufferContext(t *testing.T) {
+	setter := func(w http.ResponseWriter, r *http.Request) {
+		w.(Contexter).SetContext(&session{user: "user"})
+	}
+	var s session
+	var found bool
+	getter := func(w http.ResponseWriter, r *http.Request) {
+		found = w.(Contexter).Context(&s)
+	}
+	handler := HttpScopedHandlerWriter(HttpScopedBPHandlerWriter(Chain(setter, getter)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !found || s.user != "user" {
+		t.Fatalf("context value not found %v %+v", found, s)
+	}
+	var missing error
+	if NewBufferWriter(rec).Context(&missing) {
+		t.Fatal("unexpected context value")
+	}
+}
+
+func Test_RecoverWith(t *testing.T) {
+	var recovered interface{}
+	var stack []byte
+	onPanic := func(r *http.Request, err interface{}, s []byte) {
+		recovered, stack = err, s
+	}
+	handler := HttpScopedHandlerWriter(RecoverWith(onPanic)(Chain(a, failer)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !compare(rec, ErrorResponse()) {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if recovered != ":Failure" || len(stack) == 0 {
+		t.Fatalf("panic not reported %v", recovered)
+	}
+}
+
+func Test_RecoverBuffered(t *testing.T) {
+	var entry *AccessEntry
+	metrics := NewMetrics(nil, nil)
+	tests := map[string]ChainerFunc{
+		"compression":  Compression(0),
+		"etag":         ETag(false),
+		"ranges":       Ranges,
+		"transforming": Transforming(),
+		"servertiming": ServerTiming,
+		"headasget":    HeadAsGet,
+		"accesslog":    AccessLog(AccessSinkFunc(func(e *AccessEntry) { entry = e })),
+		"metrics":      metrics.Route("panic"),
+		"stream":       HttpScopedStreamHandlerWriter(1 << 10),
+		"limit":        HttpScopedLimitHandlerWriter(1<<10, http.StatusInsufficientStorage, nil),
+		"strict":       HttpScopedStrictHandlerWriter,
+	}
+	for name, wrapper := range tests {
+		method := "GET"
+		if name == "headasget" {
+			method = "HEAD"
+		}
+		rec := httptest.NewRecorder()
+		RecoverWith(nil)(wrapper(Chain(a, failer))).ServeHTTP(rec, httptest.NewRequest(method, "/", nil))
+		if rec.Code != http.StatusInternalServerError || rec.Body.String() != ErrorResponse().Body.String() {
+			t.Errorf("%s: unexpected response %d %q", name, rec.Code, rec.Body.String())
+		}
+	}
+	if entry == nil || entry.Code != http.StatusInternalServerError || entry.Size != 0 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if metrics.requests[requestKey{method: "GET", route: "panic", code: http.StatusInternalServerError}] != 1 {
+		t.Errorf("unexpected metrics %v", metrics.requests)
+	}
+}
+
+func Test_ChainLinkWrapIsolation(t *testing.T) {
+	var calls []string
+	link := func(name string, fail bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, name)
+			if fail {
+				panic(name)
+			}
+		}
+	}
+	wrapper := func(name string) ChainerFunc {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	quiet := RecoverWith(nil)
+	tests := []struct {
+		handler http.Handler
+		calls   string
+	}{
+		{ChainLinkWrap(quiet, link("A", false), link("B", true), link("C", false)), "A B C"},
+		{ChainLinkWrap(quiet, link("A", true), link("B", true), link("C", true)), "A B C"},
+		{ChainLinkWraps([]ChainerFunc{wrapper("R"), wrapper("S")}, link("A", false), link("B", false)), "R S A R S B"},
+		{ChainLinkWraps([]ChainerFunc{quiet, wrapper("S")}, link("A", true), link("B", false)), "S A S B"},
+	}
+	for _, test := range tests {
+		calls = nil
+		test.handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if got := fmt.Sprint(calls); got != "["+test.calls+"]" {
+			t.Errorf("expected calls [%s] got %s", test.calls, got)
+		}
+	}
+}